@@ -1,42 +1,77 @@
 package app
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/router/common/log"
 	"github.com/router/config"
 	"github.com/router/router"
 )
 
+const defaultShutdownTimeout = 30 * time.Second
+
 type App struct {
 	config       *config.Config
 	stop chan struct{}
 	router *router.Router
+	shutdownTimeout time.Duration
 	log  log.Logger
 }
 
 func NewApp(cfg *config.Config) *App {
 	app := &App{
-		stop: make(chan struct{}),
+		config: cfg,
+		stop: make(chan struct{}, 1),
+		shutdownTimeout: defaultShutdownTimeout,
 		log:  log.New("moudule", "cmd/app"),
 	}
+	if cfg.ShutdownSeconds > 0 {
+		app.shutdownTimeout = time.Duration(cfg.ShutdownSeconds) * time.Second
+	}
 	app.router = router.NewRouter(cfg)
 	return app
 }
 
+// Run serves until the app is stopped, and stops it if serving fails
 func (a *App) Run() {
-	a.router.Run()
+	if err := a.router.Run(); err != nil {
+		a.log.Error("Server failed", "error", err)
+		a.Stop()
+	}
 }
 
+// Wait blocks until SIGINT, SIGTERM or Stop, then shuts the router down
+// gracefully, giving requests in flight the shutdown timeout to finish
 func (a *App) Wait() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
 	a.log.Info("Server started ")
-	<-a.stop
-	os.Exit(1)
+	select {
+	case sig := <-signals:
+		fmt.Println()
+		a.log.Info("Signal received", "signal", sig)
+	case <-a.stop:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.shutdownTimeout)
+	defer cancel()
+	if err := a.router.Shutdown(ctx); err != nil {
+		a.log.Error("Failed to shut down gracefully", "error", err)
+	}
+	a.log.Info("Server stopped")
 }
 
+// Stop makes Wait shut the router down, as a signal would
 func (a *App) Stop() {
-	fmt.Println()
-	a.log.Info("Server stopped")
-	a.stop <- struct{}{}
+	select {
+	case a.stop <- struct{}{}:
+	default:
+	}
 }
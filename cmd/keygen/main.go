@@ -11,6 +11,11 @@ import (
 )
 
 func main() {
+    if len(os.Args) > 1 && os.Args[1] == "nonce" {
+        nonceMain(os.Args[2:])
+        return
+    }
+
 	// 커맨드라인 플래그 정의
     password := flag.String("password", "", "Password for the keystore")
     outputDir := flag.String("output", "./keystore", "Directory to store the keystore file")
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gagliardetto/solana-go"
+	"github.com/router/config"
+	"github.com/router/keystore"
+	solclient "github.com/router/network/solana"
+)
+
+// nonceMain creates durable nonce accounts under the authority of the router
+// key, funded by it, and prints them for the NonceAccounts list of the config
+func nonceMain(args []string) {
+	flags := flag.NewFlagSet("nonce", flag.ExitOnError)
+	configPath := flags.String("config", "./config.toml", "configuration toml file path, for the keystore and solana cluster")
+	password := flags.String("password", "", "Password for the keystore, overrides the config")
+	count := flags.Int("count", 1, "Number of nonce accounts to create")
+	flags.Parse(args)
+
+	cfg := config.NewConfig(*configPath)
+	if *password == "" {
+		*password = os.Getenv("KEYSTORE_PASSWORD")
+	}
+	if *password == "" {
+		*password = cfg.KeystorePassword
+	}
+	if *count <= 0 {
+		log.Fatal("Count must be positive")
+	}
+
+	routerKey, err := keystore.LoadKeypair(cfg.KeystorePath, *password)
+	if err != nil {
+		log.Fatalf("Failed to load keystore: %v", err)
+	}
+	client, err := solclient.NewSolanaClient(cfg.Solana)
+	if err != nil {
+		log.Fatalf("Failed to connect to solana: %v", err)
+	}
+
+	var created []string
+	for i := 0; i < *count; i++ {
+		nonce, err := solana.NewRandomPrivateKey()
+		if err != nil {
+			log.Fatalf("Failed to generate nonce account key: %v", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+		txHash, err := client.CreateNonceAccount(ctx, *routerKey, nonce)
+		cancel()
+		if err != nil {
+			log.Fatalf("Failed to create nonce account %s: %v", nonce.PublicKey(), err)
+		}
+		fmt.Printf("Created nonce account %s (tx %s)\n", nonce.PublicKey(), txHash)
+		created = append(created, fmt.Sprintf("%q", nonce.PublicKey().String()))
+	}
+
+	fmt.Printf("\nAuthority: %s\n", routerKey.PublicKey())
+	fmt.Println("Add them to the [Solana] section of the config:")
+	fmt.Printf("NonceAccounts = [%s]\n", strings.Join(created, ", "))
+}
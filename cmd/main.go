@@ -9,8 +9,9 @@ import (
 var configFlag = flag.String("config", "./config.toml", "configuration toml file path")
 
 func main() {
+	flag.Parse()
 	config := config.NewConfig(*configFlag)
 	app := app.NewApp(config)
-	go app.Wait()
-	app.Run()
+	go app.Run()
+	app.Wait()
 }
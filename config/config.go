@@ -10,7 +10,17 @@ type Config struct {
 	Port string
 	KeystorePath string
 	KeystorePassword string
+	StorePath string // directory of the request store, requests are kept in memory when empty
+	ShutdownSeconds int // how long requests in flight are waited for on shutdown (default 30)
 	GpingList []Gping
+	Consensus Consensus
+	Reward Reward
+	Lifecycle Lifecycle
+	Pricing Pricing
+	Credits Credits
+	Solana Solana
+	WebSocket WebSocket
+	Admin Admin
 }
 
 type Gping struct {
@@ -19,6 +29,89 @@ type Gping struct {
 	VaultAddress string
 }
 
+// Solana selects the cluster and rpc endpoints the router talks to
+type Solana struct {
+	Cluster            string   // mainnet, devnet (default), testnet, localnet or a custom rpc url
+	Endpoints          []string // rpc endpoints to use instead of the cluster's public one, in order of preference
+	HealthCheckSeconds int      // how often the endpoints are health checked (default 15)
+	NonceAccounts      []string // durable nonce accounts of the router key for payouts, created with `keygen nonce`
+	PriorityFee        PriorityFee
+}
+
+// PriorityFee configures the compute budget of transactions the router signs
+type PriorityFee struct {
+	ComputeUnitLimit   uint32 // compute units requested, default 10000 per instruction
+	Percentile         int    // percentile of recent prioritization fees to start from (default 75)
+	MinMicroLamports   uint64 // floor of the compute unit price
+	MaxMicroLamports   uint64 // ceiling of the compute unit price (default 1000000)
+	EscalationPercent  int    // price increase of every rebroadcast (default 50)
+	RebroadcastSeconds int    // how long to wait for a confirmation before rebroadcasting (default 10)
+}
+
+// Consensus configures how gping answers are combined into one location
+type Consensus struct {
+	WindowSeconds int     // how long to collect gping answers (default 10)
+	Quorum        int     // minimum number of agreeing gpings (default a strict majority of GpingList)
+	OutlierKm     float64 // answers farther than this from the median are rejected (default 50)
+}
+
+// Reward configures how the fee is split between the gpings that agreed on a location
+type Reward struct {
+	Weighting string // "accuracy" (default), "latency" or "equal"
+	MaxPayees int    // at most this many of the closest gpings are paid (default 10)
+}
+
+// Lifecycle configures how long requests may stay in each state
+type Lifecycle struct {
+	ReapIntervalSeconds int            // how often expired requests are reaped (default 30)
+	TTLSeconds          map[string]int // per state name, e.g. AwaitingApproval = 600
+}
+
+// Pricing lists the SPL tokens a query can be paid with
+type Pricing struct {
+	DefaultToken string // symbol or mint used when the client does not choose one
+	Tokens       []Token
+	// delegate (default): the client approves the router as delegate and is charged after the gpings answered.
+	// escrow: the client pays into a per-request escrow account upfront, which is released to the gping
+	// vaults after delivery or refunded when the gpings do not agree in time.
+	PaymentMode string
+}
+
+// Credits lets clients deposit tokens once to the router's token account of
+// an accepted mint and pay queries from that balance
+type Credits struct {
+	Enabled     bool
+	PollSeconds int // how often the deposit accounts are scanned for new deposits (default 15)
+}
+
+// Admin restricts the /admin apis. With neither a token nor an allow-list
+// they are only served to loopback addresses.
+type Admin struct {
+	Token    string   // bearer token admin requests must carry
+	AllowIPs []string // addresses or CIDRs admin requests may come from
+}
+
+// WebSocket configures how long a dropped client session is kept for the
+// client to reconnect to, how many of its messages are kept for replay, and
+// how connections are kept alive and protected from slow clients
+type WebSocket struct {
+	SessionTTLSeconds   int     // how long a session outlives its connection (default 300)
+	BufferSize          int     // messages kept per session for replay (default 256)
+	MaxConcurrent       int     // requests of a session handled at the same time (default 4)
+	PingSeconds         int     // how often clients are pinged (default 20)
+	PongWaitSeconds     int     // how long a client may go without answering a ping or sending anything (default 60)
+	QueueSize           int     // messages queued per connection waiting to be written (default 64)
+	SlowConsumerSeconds int     // how long a full queue may block before its client is evicted (default 5)
+	RequestsPerSecond   float64 // requests a session may make per second on average (default 5)
+	RequestBurst        int     // requests a session may make at once above that rate (default 10)
+}
+
+type Token struct {
+	Symbol string
+	Mint   string
+	Price  string // price of one query in whole tokens, e.g. "1" or "0.25"
+}
+
 func NewConfig(file string) *Config {
 	c := new(Config)
 
@@ -17,10 +17,32 @@ import (
 
 type GpingClient struct {
 	gpings []config.Gping
+	consensus config.Consensus
 }
 
 func NewGpingClient(cfg *config.Config) *GpingClient {
-	return &GpingClient{gpings: cfg.GpingList}
+	consensus := cfg.Consensus
+	if consensus.WindowSeconds <= 0 {
+		consensus.WindowSeconds = defaultWindowSeconds
+	}
+	if consensus.Quorum <= 0 {
+		// a strict majority, so no single gping decides the location alone
+		consensus.Quorum = len(cfg.GpingList)/2 + 1
+	}
+	if consensus.OutlierKm <= 0 {
+		consensus.OutlierKm = defaultOutlierKm
+	}
+	return &GpingClient{gpings: cfg.GpingList, consensus: consensus}
+}
+
+// Count returns the number of configured gpings
+func (c *GpingClient) Count() int {
+	return len(c.gpings)
+}
+
+// Window returns how long answers are collected before the consensus is computed
+func (c *GpingClient) Window() time.Duration {
+	return time.Duration(c.consensus.WindowSeconds) * time.Second
 }
 
 
@@ -0,0 +1,147 @@
+package gping
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/router/types"
+)
+
+const (
+	earthRadiusKm = 6371.0
+
+	defaultWindowSeconds = 10
+	defaultOutlierKm     = 50.0
+
+	weiszfeldIterations = 100
+	weiszfeldEpsilon    = 1e-12
+)
+
+var (
+	ErrNoAnswers = errors.New("no gping answers")
+	ErrNoQuorum  = errors.New("not enough gpings agree on a location")
+)
+
+type point struct {
+	x, y, z float64 // unit vector on the sphere
+}
+
+func pointFromLatLon(lat, lon float64) point {
+	la, lo := lat*math.Pi/180, lon*math.Pi/180
+	return point{math.Cos(la) * math.Cos(lo), math.Cos(la) * math.Sin(lo), math.Sin(la)}
+}
+
+func (p point) latLon() (float64, float64) {
+	return math.Atan2(p.z, math.Hypot(p.x, p.y)) * 180 / math.Pi, math.Atan2(p.y, p.x) * 180 / math.Pi
+}
+
+// distanceKm returns the great-circle distance between two points
+func (p point) distanceKm(q point) float64 {
+	cross := math.Sqrt(math.Pow(p.y*q.z-p.z*q.y, 2) + math.Pow(p.z*q.x-p.x*q.z, 2) + math.Pow(p.x*q.y-p.y*q.x, 2))
+	return math.Atan2(cross, p.x*q.x+p.y*q.y+p.z*q.z) * earthRadiusKm
+}
+
+// geometricMedian finds the point minimizing the sum of great-circle distances
+// with Weiszfeld's algorithm, projected back onto the sphere on every step.
+func geometricMedian(points []point) point {
+	var m point
+	for _, p := range points {
+		m.x, m.y, m.z = m.x+p.x, m.y+p.y, m.z+p.z
+	}
+	m = normalize(m, points[0])
+
+	for i := 0; i < weiszfeldIterations; i++ {
+		var next point
+		var total float64
+		for _, p := range points {
+			d := m.distanceKm(p)
+			if d < weiszfeldEpsilon {
+				// the estimate sits on an answer, which is already a good enough median
+				return p
+			}
+			w := 1 / d
+			next.x, next.y, next.z = next.x+p.x*w, next.y+p.y*w, next.z+p.z*w
+			total += w
+		}
+		next = normalize(point{next.x / total, next.y / total, next.z / total}, m)
+		moved := m.distanceKm(next)
+		m = next
+		if moved < 1e-6 {
+			break
+		}
+	}
+	return m
+}
+
+func normalize(p, fallback point) point {
+	n := math.Sqrt(p.x*p.x + p.y*p.y + p.z*p.z)
+	if n < weiszfeldEpsilon {
+		return fallback
+	}
+	return point{p.x / n, p.y / n, p.z / n}
+}
+
+// Consensus combines the gping answers collected for one request into a single
+// location. Only the first answer of each vault counts. Answers far from the
+// geometric median are rejected and the median is recomputed from the rest.
+func (c *GpingClient) Consensus(answers []*types.ResponseFromGping, broadcastAt time.Time) (*types.GeoConsensus, error) {
+	seen := make(map[string]bool)
+	votes := make([]types.GpingVote, 0, len(answers))
+	points := make([]point, 0, len(answers))
+	for _, a := range answers {
+		if seen[a.Vault] {
+			continue
+		}
+		lat, err := strconv.ParseFloat(a.Latitude, 64)
+		if err != nil || lat < -90 || lat > 90 {
+			continue
+		}
+		lon, err := strconv.ParseFloat(a.Longitude, 64)
+		if err != nil || lon < -180 || lon > 180 {
+			continue
+		}
+		seen[a.Vault] = true
+		votes = append(votes, types.GpingVote{
+			Vault:     a.Vault,
+			Latitude:  lat,
+			Longitude: lon,
+			Latency:   a.ReceivedAt.Sub(broadcastAt),
+		})
+		points = append(points, pointFromLatLon(lat, lon))
+	}
+	if len(votes) == 0 {
+		return nil, ErrNoAnswers
+	}
+
+	m := geometricMedian(points)
+	result := &types.GeoConsensus{}
+	agreeing := make([]point, 0, len(points))
+	for i, v := range votes {
+		if d := m.distanceKm(points[i]); d <= c.consensus.OutlierKm {
+			agreeing = append(agreeing, points[i])
+			result.Agreeing = append(result.Agreeing, v)
+		} else {
+			v.DistanceKm = d
+			result.Rejected = append(result.Rejected, v)
+		}
+	}
+	if len(result.Agreeing) < c.consensus.Quorum {
+		return nil, fmt.Errorf("%w: %d of %d required", ErrNoQuorum, len(result.Agreeing), c.consensus.Quorum)
+	}
+
+	m = geometricMedian(agreeing)
+	for i, p := range agreeing {
+		d := m.distanceKm(p)
+		result.Agreeing[i].DistanceKm = d
+		result.RadiusKm = math.Max(result.RadiusKm, d)
+	}
+	sort.SliceStable(result.Agreeing, func(i, j int) bool {
+		return result.Agreeing[i].DistanceKm < result.Agreeing[j].DistanceKm
+	})
+	result.Latitude, result.Longitude = m.latLon()
+	return result, nil
+}
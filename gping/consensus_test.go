@@ -0,0 +1,124 @@
+package gping
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/router/config"
+	"github.com/router/types"
+)
+
+func answer(vault string, lat, lon float64) *types.ResponseFromGping {
+	return &types.ResponseFromGping{
+		Vault:     vault,
+		Gping:     "gping-" + vault,
+		Latitude:  strconv.FormatFloat(lat, 'f', -1, 64),
+		Longitude: strconv.FormatFloat(lon, 'f', -1, 64),
+	}
+}
+
+func TestConsensus(t *testing.T) {
+	tests := []struct {
+		name     string
+		quorum   int
+		answers  []*types.ResponseFromGping
+		err      error
+		lat, lon float64 // expected location, within toleranceKm
+		rejected []string
+	}{
+		{
+			name:   "agreeing answers",
+			quorum: 2,
+			answers: []*types.ResponseFromGping{
+				answer("a", 48.8566, 2.3522),
+				answer("b", 48.8600, 2.3400),
+				answer("c", 48.8500, 2.3600),
+			},
+			lat: 48.8566, lon: 2.3522,
+		},
+		{
+			name:   "far outlier rejected",
+			quorum: 3,
+			answers: []*types.ResponseFromGping{
+				answer("a", 48.8566, 2.3522),
+				answer("b", 48.8600, 2.3400),
+				answer("c", 48.8500, 2.3600),
+				answer("d", 40.7128, -74.0060),
+			},
+			lat: 48.8566, lon: 2.3522,
+			rejected: []string{"d"},
+		},
+		{
+			name:   "no quorum",
+			quorum: 3,
+			answers: []*types.ResponseFromGping{
+				answer("a", 48.8566, 2.3522),
+				answer("b", 48.8600, 2.3400),
+				answer("c", 40.7128, -74.0060),
+				answer("d", 35.6762, 139.6503),
+			},
+			err: ErrNoQuorum,
+		},
+		{
+			name:   "repeated vault counted once",
+			quorum: 2,
+			answers: []*types.ResponseFromGping{
+				answer("a", 48.8566, 2.3522),
+				answer("a", 48.8600, 2.3400),
+			},
+			err: ErrNoQuorum,
+		},
+		{
+			name:   "across the antimeridian",
+			quorum: 3,
+			answers: []*types.ResponseFromGping{
+				answer("a", -17.0, 179.99),
+				answer("b", -17.0, -179.99),
+				answer("c", -17.01, 180),
+			},
+			lat: -17.0, lon: 180,
+		},
+		{
+			name: "no answers",
+			err:  ErrNoAnswers,
+		},
+	}
+
+	const toleranceKm = 5
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &GpingClient{consensus: config.Consensus{Quorum: tt.quorum, OutlierKm: defaultOutlierKm}}
+			result, err := c.Consensus(tt.answers, time.Now())
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("got error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := pointFromLatLon(result.Latitude, result.Longitude)
+			if d := got.distanceKm(pointFromLatLon(tt.lat, tt.lon)); d > toleranceKm {
+				t.Errorf("location %f,%f is %.1f km from %f,%f", result.Latitude, result.Longitude, d, tt.lat, tt.lon)
+			}
+			if result.RadiusKm > toleranceKm {
+				t.Errorf("radius %.1f km, want at most %d", result.RadiusKm, toleranceKm)
+			}
+			if len(result.Rejected) != len(tt.rejected) {
+				t.Fatalf("rejected %d answers, want %d", len(result.Rejected), len(tt.rejected))
+			}
+			for i, vault := range tt.rejected {
+				if result.Rejected[i].Vault != vault {
+					t.Errorf("rejected %s, want %s", result.Rejected[i].Vault, vault)
+				}
+			}
+			if want := len(tt.answers) - len(tt.rejected); len(result.Agreeing) != want {
+				t.Errorf("%d agreeing answers, want %d", len(result.Agreeing), want)
+			}
+		})
+	}
+}
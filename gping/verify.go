@@ -0,0 +1,44 @@
+package gping
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gagliardetto/solana-go"
+	"github.com/router/types"
+)
+
+var (
+	ErrUnknownGping     = errors.New("unknown gping")
+	ErrInvalidSignature = errors.New("invalid gping signature")
+	ErrVaultMismatch    = errors.New("vault does not belong to gping")
+)
+
+// VerifyResponse checks that resp was signed by the key of a configured gping
+// and that it asks to be paid into that gping's own vault.
+func (c *GpingClient) VerifyResponse(resp *types.ResponseFromGping) error {
+	for _, g := range c.gpings {
+		if g.Address != resp.Gping {
+			continue
+		}
+		pubkey, err := solana.PublicKeyFromBase58(g.Address)
+		if err != nil {
+			return fmt.Errorf("invalid address of gping %s: %v", g.Address, err)
+		}
+		if resp.Signature == "" {
+			return fmt.Errorf("%w: missing signature", ErrInvalidSignature)
+		}
+		sig, err := solana.SignatureFromBase58(resp.Signature)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+		}
+		if !sig.Verify(pubkey, resp.SigningMessage()) {
+			return ErrInvalidSignature
+		}
+		if resp.Vault != g.VaultAddress {
+			return ErrVaultMismatch
+		}
+		return nil
+	}
+	return ErrUnknownGping
+}
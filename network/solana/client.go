@@ -3,44 +3,83 @@ package solana
 import (
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/gagliardetto/solana-go"
 	"github.com/gagliardetto/solana-go/rpc"
+	"github.com/router/common/log"
+	"github.com/router/config"
 )
 
 type SolanaClient struct {
-    client *rpc.Client
+    endpoints   []*endpoint
+    priorityFee config.PriorityFee
+    log         log.Logger
+    quit        chan struct{}
+    closeOnce   sync.Once
 }
 
-func NewSolanaClient(endpoint string) *SolanaClient {
-    rpcClient := rpc.New(endpoint) // e.g., "https://api.mainnet-beta.solana.com"
-    return &SolanaClient{
-        client: rpcClient,
-	}
+// NewSolanaClient connects to the configured cluster or rpc endpoints and
+// keeps checking their health in the background
+func NewSolanaClient(cfg config.Solana) (*SolanaClient, error) {
+    endpoints, err := newEndpoints(cfg)
+    if err != nil {
+        return nil, err
+    }
+    s := &SolanaClient{
+        endpoints:   endpoints,
+        priorityFee: newPriorityFee(cfg.PriorityFee),
+        log:         log.New("module", "solana"),
+        quit:        make(chan struct{}),
+    }
+    interval := defaultHealthCheckInterval
+    if cfg.HealthCheckSeconds > 0 {
+        interval = time.Duration(cfg.HealthCheckSeconds) * time.Second
+    }
+    go s.healthLoop(interval)
+    return s, nil
 }
 
-// SendRawTransaction sends a base64 encoded signed transaction
-func (s *SolanaClient) SendRawTransaction(signedTxBase64 string) (string, error) {
-    // Decode base64 transaction
-    txBytes, err := base64.StdEncoding.DecodeString(signedTxBase64)
+// Close stops the background health checks. Calls made afterwards still go
+// to the endpoints as they were last found
+func (s *SolanaClient) Close() {
+    s.closeOnce.Do(func() { close(s.quit) })
+}
+
+// DecodeTransaction decodes a base64 encoded transaction
+func DecodeTransaction(txBase64 string) (*solana.Transaction, error) {
+    txBytes, err := base64.StdEncoding.DecodeString(txBase64)
     if err != nil {
-        return "", fmt.Errorf("failed to decode transaction: %v", err)
+        return nil, fmt.Errorf("failed to decode transaction: %v", err)
     }
 
-    // Create transaction from bytes
     tx, err := solana.TransactionFromBytes(txBytes)
     if err != nil {
-        return "", fmt.Errorf("failed to parse transaction: %v", err)
+        return nil, fmt.Errorf("failed to parse transaction: %v", err)
+    }
+    return tx, nil
+}
+
+// SendRawTransaction sends a base64 encoded signed transaction
+func (s *SolanaClient) SendRawTransaction(signedTxBase64 string) (string, error) {
+    tx, err := DecodeTransaction(signedTxBase64)
+    if err != nil {
+        return "", err
     }
 
     // Send transaction
-    sig, err := s.client.SendTransactionWithOpts(context.Background(), tx,
-        rpc.TransactionOpts{
-            SkipPreflight:       false,
-            PreflightCommitment: rpc.CommitmentConfirmed,
-        },
-    )
+    ctx := context.Background()
+    sig, err := s.broadcast(ctx, func(c *rpc.Client) (solana.Signature, error) {
+        return c.SendTransactionWithOpts(ctx, tx,
+            rpc.TransactionOpts{
+                SkipPreflight:       false,
+                PreflightCommitment: rpc.CommitmentConfirmed,
+            },
+        )
+    })
     if err != nil {
         return "", fmt.Errorf("failed to send transaction: %v", err)
     }
@@ -48,49 +87,199 @@ func (s *SolanaClient) SendRawTransaction(signedTxBase64 string) (string, error)
     return sig.String(), nil
 }
 
-// WaitForTransactionConfirmation waits for a transaction to be confirmed
-func (s *SolanaClient) WaitForTransactionConfirmation(txHash string) (*rpc.GetSignatureStatusesResult, error) {
-    sig := solana.MustSignatureFromBase58(txHash)
-
-    status, err := s.client.GetSignatureStatuses(
-        context.Background(),
-        true,  // searchTransactionHistory
-        sig,   // can pass multiple signatures
-    )
+const (
+    confirmPollInitial = 500 * time.Millisecond
+    confirmPollMax     = 5 * time.Second
+    // how long WaitForTransactionConfirmation waits when the blockhash expiry is unknown
+    defaultConfirmTimeout = 90 * time.Second
+)
+
+// ErrBlockhashExpired is returned when the chain passed the last valid block
+// height of a transaction's blockhash before the transaction was confirmed.
+// The transaction can no longer land.
+var ErrBlockhashExpired = errors.New("blockhash expired before the transaction was confirmed")
+
+// TransactionError is returned for a transaction that landed but failed on chain
+type TransactionError struct {
+    Signature string
+    Err       interface{} // the on-chain error as reported by the rpc, e.g. {"InstructionError":[0,...]}
+}
+
+func (e *TransactionError) Error() string {
+    return fmt.Sprintf("transaction %s failed: %v", e.Signature, e.Err)
+}
+
+var commitmentRank = map[rpc.ConfirmationStatusType]int{
+    rpc.ConfirmationStatusProcessed: 1,
+    rpc.ConfirmationStatusConfirmed: 2,
+    rpc.ConfirmationStatusFinalized: 3,
+}
+
+func reached(status rpc.ConfirmationStatusType, commitment rpc.CommitmentType) bool {
+    return commitmentRank[status] >= commitmentRank[rpc.ConfirmationStatusType(commitment)]
+}
+
+// ConfirmTransaction polls the status of a transaction with backoff until it
+// reaches commitment (processed, confirmed or finalized). It returns a
+// *TransactionError if the transaction failed on chain, and ErrBlockhashExpired
+// once the block height passes lastValidBlockHeight without the transaction
+// landing. A lastValidBlockHeight of 0 disables the expiry check, e.g. for
+// durable nonce transactions, so ctx must bound the wait.
+func (s *SolanaClient) ConfirmTransaction(ctx context.Context, txHash string, commitment rpc.CommitmentType, lastValidBlockHeight uint64) (*rpc.SignatureStatusesResult, error) {
+    sig, err := solana.SignatureFromBase58(txHash)
     if err != nil {
-        return nil, fmt.Errorf("failed to get transaction status: %v", err)
+        return nil, fmt.Errorf("invalid transaction signature: %v", err)
     }
+    result, _, err := s.confirmAny(ctx, []solana.Signature{sig}, commitment, lastValidBlockHeight)
+    return result, err
+}
+
+// confirmAny is ConfirmTransaction for several transactions of which at most
+// one can land, e.g. rebroadcasts of a payout with different fees. It returns
+// the signature of the one that did.
+func (s *SolanaClient) confirmAny(ctx context.Context, sigs []solana.Signature, commitment rpc.CommitmentType, lastValidBlockHeight uint64) (*rpc.SignatureStatusesResult, string, error) {
+    delay := confirmPollInitial
+    expired := false
+    for {
+        var status *rpc.GetSignatureStatusesResult
+        err := s.call(ctx, func(c *rpc.Client) (err error) {
+            status, err = c.GetSignatureStatuses(ctx, true, sigs...)
+            return
+        })
+        if err != nil && !errors.Is(err, rpc.ErrNotFound) {
+            return nil, "", fmt.Errorf("failed to get transaction status: %w", err)
+        }
 
-    if status == nil || status.Value[0] == nil {
-        return nil, fmt.Errorf("transaction not found")
+        landed := false
+        failed := -1
+        if err == nil {
+            for i, result := range status.Value {
+                if result == nil || i >= len(sigs) {
+                    continue
+                }
+                landed = true
+                if result.Err != nil {
+                    failed = i
+                } else if reached(result.ConfirmationStatus, commitment) {
+                    return result, sigs[i].String(), nil
+                }
+            }
+        }
+        if failed >= 0 {
+            return status.Value[failed], sigs[failed].String(), &TransactionError{Signature: sigs[failed].String(), Err: status.Value[failed].Err}
+        }
+        if !landed && expired {
+            return nil, "", ErrBlockhashExpired
+        } else if !landed && lastValidBlockHeight > 0 {
+            var height uint64
+            err := s.call(ctx, func(c *rpc.Client) (err error) {
+                height, err = c.GetBlockHeight(ctx, rpc.CommitmentConfirmed)
+                return
+            })
+            if err == nil && height > lastValidBlockHeight {
+                // look once more, the transaction may have landed just before the expiry
+                expired = true
+                continue
+            }
+        }
+
+        select {
+        case <-ctx.Done():
+            return nil, "", fmt.Errorf("transaction %s not %s: %w", sigs[len(sigs)-1], commitment, ctx.Err())
+        case <-time.After(delay):
+        }
+        if delay = delay * 3 / 2; delay > confirmPollMax {
+            delay = confirmPollMax
+        }
     }
+}
+
+// ConfirmAny is ConfirmTransaction for several versions of a transaction of
+// which at most one can land. It returns the signature of the one that did.
+func (s *SolanaClient) ConfirmAny(ctx context.Context, txHashes []string, commitment rpc.CommitmentType, lastValidBlockHeight uint64) (string, error) {
+    sigs := make([]solana.Signature, 0, len(txHashes))
+    for _, txHash := range txHashes {
+        sig, err := solana.SignatureFromBase58(txHash)
+        if err != nil {
+            return "", fmt.Errorf("invalid transaction signature: %v", err)
+        }
+        sigs = append(sigs, sig)
+    }
+    _, txHash, err := s.confirmAny(ctx, sigs, commitment, lastValidBlockHeight)
+    return txHash, err
+}
 
-    return status, nil
+// WaitForTransactionConfirmation waits for a transaction to be confirmed
+func (s *SolanaClient) WaitForTransactionConfirmation(txHash string) (*rpc.SignatureStatusesResult, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), defaultConfirmTimeout)
+    defer cancel()
+    return s.ConfirmTransaction(ctx, txHash, rpc.CommitmentConfirmed, 0)
 }
 
 // GetBalance gets the SOL balance of an account
 func (s *SolanaClient) GetBalance(address string) (uint64, error) {
     pubKey := solana.MustPublicKeyFromBase58(address)
     
-    balance, err := s.client.GetBalance(
-        context.Background(),
-        pubKey,
-        rpc.CommitmentConfirmed, // specify the commitment level
-    )
+    var balance *rpc.GetBalanceResult
+    ctx := context.Background()
+    err := s.call(ctx, func(c *rpc.Client) (err error) {
+        balance, err = c.GetBalance(
+            ctx,
+            pubKey,
+            rpc.CommitmentConfirmed, // specify the commitment level
+        )
+        return
+    })
     if err != nil {
         return 0, fmt.Errorf("failed to get balance: %v", err)
     }
 
     return balance.Value, nil
 }
-// GetRecentBlockhash gets the most recent blockhash
-func (s *SolanaClient) GetRecentBlockhash(ctx context.Context) (*rpc.GetRecentBlockhashResult, error) {
-    return s.client.GetRecentBlockhash(ctx, rpc.CommitmentConfirmed)
+// GetMintDecimals reads the number of decimals of a SPL token mint
+func (s *SolanaClient) GetMintDecimals(ctx context.Context, mint solana.PublicKey) (uint8, error) {
+    var supply *rpc.GetTokenSupplyResult
+    err := s.call(ctx, func(c *rpc.Client) (err error) {
+        supply, err = c.GetTokenSupply(ctx, mint, rpc.CommitmentConfirmed)
+        return
+    })
+    if err != nil {
+        return 0, fmt.Errorf("failed to get token supply: %v", err)
+    }
+    return supply.Value.Decimals, nil
+}
+
+// GetRentExemption gets the minimum balance of a rent exempt account of size bytes
+func (s *SolanaClient) GetRentExemption(ctx context.Context, size uint64) (uint64, error) {
+    var lamports uint64
+    err := s.call(ctx, func(c *rpc.Client) (err error) {
+        lamports, err = c.GetMinimumBalanceForRentExemption(ctx, size, rpc.CommitmentConfirmed)
+        return
+    })
+    if err != nil {
+        return 0, fmt.Errorf("failed to get rent exemption: %v", err)
+    }
+    return lamports, nil
+}
+
+// GetLatestBlockhash gets the latest blockhash and the last block height it is valid for
+func (s *SolanaClient) GetLatestBlockhash(ctx context.Context) (*rpc.LatestBlockhashResult, error) {
+    var latest *rpc.GetLatestBlockhashResult
+    err := s.call(ctx, func(c *rpc.Client) (err error) {
+        latest, err = c.GetLatestBlockhash(ctx, rpc.CommitmentFinalized)
+        return
+    })
+    if err != nil {
+        return nil, fmt.Errorf("failed to get latest blockhash: %v", err)
+    }
+    return latest.Value, nil
 }
 
 // SendTransaction sends a transaction to the network
 func (s *SolanaClient) SendTransaction(ctx context.Context, tx *solana.Transaction) (string, error) {
-    sig, err := s.client.SendTransaction(ctx, tx)
+    sig, err := s.broadcast(ctx, func(c *rpc.Client) (solana.Signature, error) {
+        return c.SendTransaction(ctx, tx)
+    })
     if err != nil {
         return "", fmt.Errorf("failed to send transaction: %v", err)
     }
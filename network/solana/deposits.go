@@ -0,0 +1,163 @@
+package solana
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/gagliardetto/solana-go"
+	"github.com/gagliardetto/solana-go/rpc"
+)
+
+// signatures per GetSignaturesForAddress page, the rpc maximum
+const signaturePageSize = 1000
+
+// TokenTransfer is a finalized transaction that increased the balance of a
+// token account. Sender is the owner of the only account of the mint whose
+// balance decreased in it, and zero if there was not exactly one such owner.
+type TokenTransfer struct {
+	Signature string
+	Slot      uint64
+	Sender    solana.PublicKey
+	Amount    uint64
+}
+
+// IncomingTransfers lists the transfers into account of mint that finalized
+// after the transaction until, oldest first. An empty until lists the whole
+// history of the account. It also returns the newest signature seen, to be
+// passed as until next time.
+func (s *SolanaClient) IncomingTransfers(ctx context.Context, account, mint solana.PublicKey, until string) ([]TokenTransfer, string, error) {
+	opts := &rpc.GetSignaturesForAddressOpts{Commitment: rpc.CommitmentFinalized}
+	if until != "" {
+		sig, err := solana.SignatureFromBase58(until)
+		if err != nil {
+			return nil, until, fmt.Errorf("invalid signature %s: %v", until, err)
+		}
+		opts.Until = sig
+	}
+	limit := signaturePageSize
+	opts.Limit = &limit
+
+	// pages come newest first
+	var sigs []*rpc.TransactionSignature
+	for {
+		var page []*rpc.TransactionSignature
+		err := s.call(ctx, func(c *rpc.Client) (err error) {
+			page, err = c.GetSignaturesForAddressWithOpts(ctx, account, opts)
+			return
+		})
+		if err != nil {
+			return nil, until, fmt.Errorf("failed to get signatures of %s: %v", account, err)
+		}
+		sigs = append(sigs, page...)
+		if len(page) < signaturePageSize {
+			break
+		}
+		opts.Before = page[len(page)-1].Signature
+	}
+	if len(sigs) == 0 {
+		return nil, until, nil
+	}
+
+	var transfers []TokenTransfer
+	for i := len(sigs) - 1; i >= 0; i-- {
+		if sigs[i].Err != nil {
+			continue
+		}
+		transfer, err := s.tokenTransfer(ctx, sigs[i].Signature, account, mint)
+		if err != nil {
+			return nil, until, err
+		}
+		if transfer != nil {
+			transfers = append(transfers, *transfer)
+		}
+	}
+	return transfers, sigs[0].Signature.String(), nil
+}
+
+// NewestSignature returns the newest finalized transaction of account, or an
+// empty string if it has none
+func (s *SolanaClient) NewestSignature(ctx context.Context, account solana.PublicKey) (string, error) {
+	limit := 1
+	opts := &rpc.GetSignaturesForAddressOpts{Commitment: rpc.CommitmentFinalized, Limit: &limit}
+	var page []*rpc.TransactionSignature
+	err := s.call(ctx, func(c *rpc.Client) (err error) {
+		page, err = c.GetSignaturesForAddressWithOpts(ctx, account, opts)
+		return
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get signatures of %s: %v", account, err)
+	}
+	if len(page) == 0 {
+		return "", nil
+	}
+	return page[0].Signature.String(), nil
+}
+
+// tokenTransfer reads how much transaction sig added to account, or nil if it did not add to it
+func (s *SolanaClient) tokenTransfer(ctx context.Context, sig solana.Signature, account, mint solana.PublicKey) (*TokenTransfer, error) {
+	version := uint64(0)
+	var result *rpc.GetTransactionResult
+	err := s.call(ctx, func(c *rpc.Client) (err error) {
+		result, err = c.GetTransaction(ctx, sig, &rpc.GetTransactionOpts{
+			Encoding:                       solana.EncodingBase64,
+			Commitment:                     rpc.CommitmentFinalized,
+			MaxSupportedTransactionVersion: &version,
+		})
+		return
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transaction %s: %v", sig, err)
+	}
+	if result.Meta == nil || result.Meta.Err != nil || result.Transaction == nil {
+		return nil, nil
+	}
+	tx, err := result.Transaction.GetTransaction()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode transaction %s: %v", sig, err)
+	}
+	keys := append(solana.PublicKeySlice{}, tx.Message.AccountKeys...)
+	keys = append(keys, result.Meta.LoadedAddresses.Writable...)
+	keys = append(keys, result.Meta.LoadedAddresses.ReadOnly...)
+
+	// balance changes of the mint per account, and the owners of the accounts
+	changes := make(map[uint16]int64)
+	owners := make(map[uint16]solana.PublicKey)
+	for sign, balances := range map[int64][]rpc.TokenBalance{-1: result.Meta.PreTokenBalances, 1: result.Meta.PostTokenBalances} {
+		for _, b := range balances {
+			if !b.Mint.Equals(mint) || b.UiTokenAmount == nil {
+				continue
+			}
+			amount, err := strconv.ParseInt(b.UiTokenAmount.Amount, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid token amount in transaction %s: %v", sig, err)
+			}
+			changes[b.AccountIndex] += sign * amount
+			if b.Owner != nil {
+				owners[b.AccountIndex] = *b.Owner
+			}
+		}
+	}
+
+	transfer := &TokenTransfer{Signature: sig.String(), Slot: result.Slot}
+	senders := make(map[solana.PublicKey]bool)
+	for index, change := range changes {
+		if int(index) >= len(keys) {
+			continue
+		}
+		if keys[index].Equals(account) && change > 0 {
+			transfer.Amount = uint64(change)
+		} else if change < 0 {
+			senders[owners[index]] = true
+		}
+	}
+	if transfer.Amount == 0 {
+		return nil, nil
+	}
+	if len(senders) == 1 {
+		for sender := range senders {
+			transfer.Sender = sender
+		}
+	}
+	return transfer, nil
+}
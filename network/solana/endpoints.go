@@ -0,0 +1,191 @@
+package solana
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gagliardetto/solana-go"
+	"github.com/gagliardetto/solana-go/rpc"
+	"github.com/gagliardetto/solana-go/rpc/jsonrpc"
+	"github.com/router/config"
+)
+
+const defaultHealthCheckInterval = 15 * time.Second
+
+var clusters = map[string]rpc.Cluster{
+	"mainnet":      rpc.MainNetBeta,
+	"mainnet-beta": rpc.MainNetBeta,
+	"devnet":       rpc.DevNet,
+	"testnet":      rpc.TestNet,
+	"localnet":     rpc.LocalNet,
+}
+
+type endpoint struct {
+	url     string
+	client  *rpc.Client
+	healthy atomic.Bool
+}
+
+// endpointURLs returns the rpc endpoints to use: the configured list, or the
+// public endpoint of the cluster, which may itself be a custom url
+func endpointURLs(cfg config.Solana) ([]string, error) {
+	if len(cfg.Endpoints) > 0 {
+		return cfg.Endpoints, nil
+	}
+	if cfg.Cluster == "" {
+		return []string{rpc.DevNet.RPC}, nil
+	}
+	if cluster, ok := clusters[cfg.Cluster]; ok {
+		return []string{cluster.RPC}, nil
+	}
+	if strings.HasPrefix(cfg.Cluster, "http://") || strings.HasPrefix(cfg.Cluster, "https://") {
+		return []string{cfg.Cluster}, nil
+	}
+	return nil, fmt.Errorf("unknown solana cluster %q", cfg.Cluster)
+}
+
+// ordered returns the healthy endpoints first, keeping the configured order
+// within each group, so unhealthy ones are still tried as a last resort
+func (s *SolanaClient) ordered() []*endpoint {
+	out := make([]*endpoint, 0, len(s.endpoints))
+	for _, e := range s.endpoints {
+		if e.healthy.Load() {
+			out = append(out, e)
+		}
+	}
+	for _, e := range s.endpoints {
+		if !e.healthy.Load() {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// isNodeError reports whether err came from the node itself, e.g. a failed
+// simulation or an unknown transaction. Such errors are the same on every
+// endpoint, so there is no point in failing over.
+func isNodeError(err error) bool {
+	var rpcErr *jsonrpc.RPCError
+	return errors.As(err, &rpcErr) || errors.Is(err, rpc.ErrNotFound)
+}
+
+// call runs fn against the endpoints in order until one of them answers. fn
+// must use ctx: once it is done the error is the caller's, not the endpoint's,
+// so the endpoint is not marked unhealthy and no other endpoint is tried.
+func (s *SolanaClient) call(ctx context.Context, fn func(client *rpc.Client) error) error {
+	var err error
+	for _, e := range s.ordered() {
+		if err = fn(e.client); err == nil || isNodeError(err) || ctx.Err() != nil {
+			return err
+		}
+		s.markHealth(e, false, err)
+	}
+	return err
+}
+
+// broadcast sends the same transaction through every healthy endpoint in
+// parallel and returns the first signature any of them accepted. Like call, it
+// leaves the endpoints' health alone once ctx is done.
+func (s *SolanaClient) broadcast(ctx context.Context, send func(client *rpc.Client) (solana.Signature, error)) (solana.Signature, error) {
+	targets := make([]*endpoint, 0, len(s.endpoints))
+	for _, e := range s.endpoints {
+		if e.healthy.Load() {
+			targets = append(targets, e)
+		}
+	}
+	if len(targets) == 0 {
+		targets = s.endpoints
+	}
+
+	type result struct {
+		sig solana.Signature
+		err error
+	}
+	results := make(chan result, len(targets))
+	for _, e := range targets {
+		go func(e *endpoint) {
+			sig, err := send(e.client)
+			if err != nil && !isNodeError(err) && ctx.Err() == nil {
+				s.markHealth(e, false, err)
+			}
+			results <- result{sig, err}
+		}(e)
+	}
+
+	var firstErr error
+	for range targets {
+		r := <-results
+		if r.err == nil {
+			return r.sig, nil
+		}
+		if ctx.Err() != nil {
+			return solana.Signature{}, r.err
+		}
+		if firstErr == nil || isNodeError(r.err) {
+			firstErr = r.err
+		}
+	}
+	return solana.Signature{}, firstErr
+}
+
+func (s *SolanaClient) markHealth(e *endpoint, healthy bool, err error) {
+	if e.healthy.Swap(healthy) == healthy {
+		return
+	}
+	if healthy {
+		s.log.Info("Solana rpc endpoint is healthy", "url", e.url)
+	} else {
+		s.log.Warn("Solana rpc endpoint is unhealthy", "url", e.url, "error", err)
+	}
+}
+
+// checkHealth asks every endpoint for its health
+func (s *SolanaClient) checkHealth() {
+	var wg sync.WaitGroup
+	for _, e := range s.endpoints {
+		wg.Add(1)
+		go func(e *endpoint) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			health, err := e.client.GetHealth(ctx)
+			if err == nil && health != rpc.HealthOk {
+				err = fmt.Errorf("node reports %s", health)
+			}
+			s.markHealth(e, err == nil, err)
+		}(e)
+	}
+	wg.Wait()
+}
+
+func (s *SolanaClient) healthLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.checkHealth()
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+func newEndpoints(cfg config.Solana) ([]*endpoint, error) {
+	urls, err := endpointURLs(cfg)
+	if err != nil {
+		return nil, err
+	}
+	endpoints := make([]*endpoint, 0, len(urls))
+	for _, url := range urls {
+		e := &endpoint{url: url, client: rpc.New(url)}
+		e.healthy.Store(true) // until a check says otherwise
+		endpoints = append(endpoints, e)
+	}
+	return endpoints, nil
+}
@@ -0,0 +1,169 @@
+package solana
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gagliardetto/solana-go"
+	computebudget "github.com/gagliardetto/solana-go/programs/compute-budget"
+	"github.com/gagliardetto/solana-go/rpc"
+	"github.com/router/config"
+)
+
+const (
+	defaultUnitsPerInstruction = 10_000
+	defaultFeePercentile       = 75
+	defaultMaxMicroLamports    = 1_000_000
+	defaultEscalationPercent   = 50
+	defaultRebroadcastInterval = 10 * time.Second
+)
+
+func newPriorityFee(cfg config.PriorityFee) config.PriorityFee {
+	if cfg.Percentile <= 0 || cfg.Percentile > 100 {
+		cfg.Percentile = defaultFeePercentile
+	}
+	if cfg.MaxMicroLamports == 0 {
+		cfg.MaxMicroLamports = defaultMaxMicroLamports
+	}
+	if cfg.MinMicroLamports > cfg.MaxMicroLamports {
+		cfg.MinMicroLamports = cfg.MaxMicroLamports
+	}
+	if cfg.EscalationPercent <= 0 {
+		cfg.EscalationPercent = defaultEscalationPercent
+	}
+	if cfg.RebroadcastSeconds <= 0 {
+		cfg.RebroadcastSeconds = int(defaultRebroadcastInterval / time.Second)
+	}
+	return cfg
+}
+
+// EstimatePriorityFee returns the configured percentile of the compute unit
+// prices recently paid for transactions writing to accounts, clamped to the
+// configured floor and ceiling
+func (s *SolanaClient) EstimatePriorityFee(ctx context.Context, accounts []solana.PublicKey) (uint64, error) {
+	var recent []rpc.PriorizationFeeResult
+	err := s.call(ctx, func(c *rpc.Client) (err error) {
+		recent, err = c.GetRecentPrioritizationFees(ctx, accounts)
+		return
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get recent prioritization fees: %v", err)
+	}
+
+	var fee uint64
+	if len(recent) > 0 {
+		fees := make([]uint64, len(recent))
+		for i, r := range recent {
+			fees[i] = r.PrioritizationFee
+		}
+		sort.Slice(fees, func(i, j int) bool { return fees[i] < fees[j] })
+		fee = fees[(len(fees)-1)*s.priorityFee.Percentile/100]
+	}
+	return s.clampFee(fee), nil
+}
+
+func (s *SolanaClient) clampFee(fee uint64) uint64 {
+	if fee < s.priorityFee.MinMicroLamports {
+		return s.priorityFee.MinMicroLamports
+	}
+	if fee > s.priorityFee.MaxMicroLamports {
+		return s.priorityFee.MaxMicroLamports
+	}
+	return fee
+}
+
+// ComputeBudget returns the instructions setting the compute unit limit of a
+// transaction with n other instructions and its compute unit price
+func (s *SolanaClient) ComputeBudget(n int, microLamports uint64) []solana.Instruction {
+	limit := s.priorityFee.ComputeUnitLimit
+	if limit == 0 {
+		limit = uint32(n) * defaultUnitsPerInstruction
+	}
+	return []solana.Instruction{
+		computebudget.NewSetComputeUnitLimitInstruction(limit).Build(),
+		computebudget.NewSetComputeUnitPriceInstruction(microLamports).Build(),
+	}
+}
+
+// SendWithPriorityFee sends the transaction build returns for the estimated
+// compute unit price, and rebroadcasts it every RebroadcastSeconds until one
+// of the sent transactions confirms, fails on chain, the blockhash passes
+// lastValidBlockHeight or ctx is done.
+//
+// With escalate, every rebroadcast is rebuilt with an escalated price, up to
+// the price ceiling. Any one of the built transactions may land, so they must
+// be mutually exclusive, e.g. by spending the same allowance or advancing the
+// same nonce. Without it, the first transaction is rebroadcast as is.
+// earlier are versions sent before, which are watched as well.
+// sent is called with every transaction built before it is sent, and the
+// transaction is not sent if it fails.
+func (s *SolanaClient) SendWithPriorityFee(
+	ctx context.Context,
+	writable []solana.PublicKey,
+	lastValidBlockHeight uint64,
+	earlier []solana.Signature,
+	escalate bool,
+	build func(microLamports uint64) (*solana.Transaction, error),
+	sent func(tx *solana.Transaction) error,
+) (string, error) {
+	fee, err := s.EstimatePriorityFee(ctx, writable)
+	if err != nil {
+		// congestion info is an optimization, the floor still gets the transaction out
+		s.log.Warn("Failed to estimate priority fee", "error", err)
+		fee = s.priorityFee.MinMicroLamports
+	}
+
+	interval := time.Duration(s.priorityFee.RebroadcastSeconds) * time.Second
+	var tx *solana.Transaction
+	sigs := append([]solana.Signature{}, earlier...)
+	accepted := false
+	for {
+		if tx == nil || escalate {
+			next, err := build(fee)
+			if err != nil {
+				return "", err
+			}
+			if err := sent(next); err != nil {
+				return "", err
+			}
+			tx = next
+			sigs = append(sigs, tx.Signatures[0])
+		}
+		_, err := s.broadcast(ctx, func(c *rpc.Client) (solana.Signature, error) {
+			return c.SendTransactionWithOpts(ctx, tx, rpc.TransactionOpts{
+				SkipPreflight:       false,
+				PreflightCommitment: rpc.CommitmentConfirmed,
+			})
+		})
+		if err != nil && !accepted {
+			return "", fmt.Errorf("failed to send transaction: %v", err)
+		} else if err != nil {
+			// an earlier broadcast may still land, keep watching it
+			s.log.Warn("Failed to rebroadcast transaction", "micro_lamports", fee, "error", err)
+		} else {
+			accepted = true
+			s.log.Debug("Transaction broadcast", "tx", tx.Signatures[0], "micro_lamports", fee)
+		}
+
+		waitCtx, cancel := context.WithTimeout(ctx, interval)
+		_, txHash, err := s.confirmAny(waitCtx, sigs, rpc.CommitmentConfirmed, lastValidBlockHeight)
+		cancel()
+		if err == nil {
+			return txHash, nil
+		}
+		if waitCtx.Err() == nil || ctx.Err() != nil {
+			// landed and failed, blockhash expired, or the caller gave up
+			return txHash, err
+		}
+
+		if escalate {
+			next := s.clampFee(fee + fee*uint64(s.priorityFee.EscalationPercent)/100)
+			if next == fee && fee < s.priorityFee.MaxMicroLamports {
+				next = fee + 1
+			}
+			fee = next
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package solana
+
+import (
+	"context"
+	"fmt"
+
+	bin "github.com/gagliardetto/binary"
+	"github.com/gagliardetto/solana-go"
+	"github.com/gagliardetto/solana-go/programs/system"
+	"github.com/gagliardetto/solana-go/rpc"
+)
+
+// NonceAccountSize is the size of a durable nonce account
+const NonceAccountSize = 80
+
+const nonceInitialized = 1
+
+// GetNonce reads a durable nonce account. The Nonce of the result is used as
+// the blockhash of transactions advancing it.
+func (s *SolanaClient) GetNonce(ctx context.Context, account solana.PublicKey) (*system.NonceAccount, error) {
+	var info *rpc.GetAccountInfoResult
+	err := s.call(ctx, func(c *rpc.Client) (err error) {
+		info, err = c.GetAccountInfoWithOpts(ctx, account, &rpc.GetAccountInfoOpts{
+			Encoding:   solana.EncodingBase64,
+			Commitment: rpc.CommitmentConfirmed,
+		})
+		return
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get nonce account %s: %v", account, err)
+	}
+	if !info.Value.Owner.Equals(solana.SystemProgramID) {
+		return nil, fmt.Errorf("%s is not a nonce account", account)
+	}
+
+	var nonce system.NonceAccount
+	if err := bin.NewBinDecoder(info.Value.Data.GetBinary()).Decode(&nonce); err != nil {
+		return nil, fmt.Errorf("failed to decode nonce account %s: %v", account, err)
+	}
+	if nonce.State != nonceInitialized {
+		return nil, fmt.Errorf("nonce account %s is not initialized", account)
+	}
+	return &nonce, nil
+}
+
+// CreateNonceAccount creates a durable nonce account at the address of nonce,
+// funded by and under the authority of payer, and waits for it to confirm
+func (s *SolanaClient) CreateNonceAccount(ctx context.Context, payer, nonce solana.PrivateKey) (string, error) {
+	rent, err := s.GetRentExemption(ctx, NonceAccountSize)
+	if err != nil {
+		return "", err
+	}
+	latest, err := s.GetLatestBlockhash(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := solana.NewTransaction(
+		[]solana.Instruction{
+			system.NewCreateAccountInstruction(rent, NonceAccountSize, solana.SystemProgramID, payer.PublicKey(), nonce.PublicKey()).Build(),
+			system.NewInitializeNonceAccountInstruction(payer.PublicKey(), nonce.PublicKey(), solana.SysVarRecentBlockHashesPubkey, solana.SysVarRentPubkey).Build(),
+		},
+		latest.Blockhash,
+		solana.TransactionPayer(payer.PublicKey()),
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to create transaction: %v", err)
+	}
+	_, err = tx.Sign(func(key solana.PublicKey) *solana.PrivateKey {
+		switch {
+		case key.Equals(payer.PublicKey()):
+			return &payer
+		case key.Equals(nonce.PublicKey()):
+			return &nonce
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to sign transaction: %v", err)
+	}
+
+	txHash, err := s.SendTransaction(ctx, tx)
+	if err != nil {
+		return "", err
+	}
+	if _, err := s.ConfirmTransaction(ctx, txHash, rpc.CommitmentConfirmed, latest.LastValidBlockHeight); err != nil {
+		return txHash, err
+	}
+	return txHash, nil
+}
@@ -2,46 +2,321 @@ package ws
 
 import (
 	"encoding/json"
+	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/router/common/log"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
+// WSClient is a client session, as seen by the handler of one message. The
+// session outlives the connection it was opened on: a client reconnecting
+// with the session's token resumes it on a new connection, and is replayed
+// the messages it missed in between. Messages sent through the WSClient a
+// handler was given carry the id of the message it handles.
 type WSClient struct {
-	ws             *websocket.Conn
-	latestSendTime time.Time
+	*session
+	msgID json.RawMessage
+}
+
+type session struct {
+	id             string
+	token          string
+	version        int // protocol version negotiated when the session was opened
+	done           chan struct{}
 	log            log.Logger
 	context        sync.Map
+	settings       *settings
+	mux            *Mux          // routes the session's requests
+	handlers       chan struct{} // one slot per handler running concurrently
+	latestSendTime atomic.Int64  // unix nano of the last write
+	counters       counters
+
+	sendLock       sync.Mutex // held by sends that may wait, see enqueue
+	lock           sync.Mutex // guards the fields below
+	conn           *outbound  // nil while the client is disconnected
+	attaching      *outbound  // a connection being sent the replay, see attach
+	waitingOn      *outbound  // a connection a send waits for room on, see enqueue
+	disconnectedAt time.Time
+	seq            uint64
+	buffer         []bufferedMsg
+
+	wallet string // guarded by the hub's sessions lock
 }
 
-func newWsClient(ws *websocket.Conn) *WSClient {
-	ws.SetReadLimit(512)
-	return &WSClient{
-		ws:             ws,
-		latestSendTime: time.Now(),
-		log:            log.New("module", "websocket"),
+func newWsClient(version int, settings *settings, mux *Mux) (*WSClient, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return nil, err
+	}
+	s := &session{
+		id:       uuid.New().String(),
+		token:    token,
+		version:  version,
+		done:     make(chan struct{}),
+		settings: settings,
+		mux:      mux,
+		handlers: make(chan struct{}, settings.maxConcurrent),
+		log:      log.New("module", "websocket"),
 	}
+	s.latestSendTime.Store(time.Now().UnixNano())
+	return &WSClient{session: s}, nil
 }
 
-func (p *WSClient) sendMsg(v interface{}) error {
-	var (
-		bytes []byte
-		err   error
-	)
+// forMessage is the view of the session given to the handler of message id
+func (p *WSClient) forMessage(id json.RawMessage) *WSClient {
+	return &WSClient{session: p.session, msgID: id}
+}
+
+// Session is the view of the session not tied to any message
+func (p *WSClient) Session() *WSClient {
+	return &WSClient{session: p.session}
+}
 
-	if bytes, err = json.Marshal(v); err == nil {
-		p.ws.SetWriteDeadline(time.Now().Add(10e9))
-		err = p.ws.WriteMessage(websocket.TextMessage, bytes)
+// sendMsg encodes msg in the session's protocol version, see send
+func (p *WSClient) sendMsg(msg *Message) error {
+	return p.send(func(seq uint64) ([]byte, error) {
+		return encode(p.version, msg, seq, p.msgID)
+	})
+}
+
+// fanOutMsg is sendMsg for messages sent to many sessions at once, which
+// must not wait on any of them: a client whose queue is full is evicted at
+// once rather than after the slow consumer timeout.
+func (p *WSClient) fanOutMsg(msg *Message) error {
+	return p.enqueue(func(seq uint64) ([]byte, error) {
+		return encode(p.version, msg, seq, p.msgID)
+	}, 0)
+}
+
+// send numbers a message with the session's next sequence number and keeps
+// it for replay before queueing it to the connection's writer. ErrDisconnected
+// is returned while the client is away, the message is replayed if it comes
+// back in time.
+func (p *WSClient) send(encode func(seq uint64) ([]byte, error)) error {
+	return p.enqueue(encode, p.settings.slowConsumer)
+}
+
+// enqueue is send, evicting a client whose queue stays full for evictAfter.
+// The message is queued under lock while there is room, keeping messages in
+// the order of their seq; waiting for room is done without it, as the hub
+// takes it to look at the session.
+func (p *WSClient) enqueue(encode func(seq uint64) ([]byte, error), evictAfter time.Duration) error {
+	if evictAfter > 0 {
+		// sends that may wait are made one at a time, so none overtakes another
+		p.sendLock.Lock()
+		defer p.sendLock.Unlock()
 	}
+	p.lock.Lock()
+	bytes, err := encode(p.seq + 1)
 	if err != nil {
+		p.lock.Unlock()
 		return err
 	}
-	p.latestSendTime = time.Now()
-	return nil
+	p.seq++
+	p.buffer = append(p.buffer, bufferedMsg{seq: p.seq, data: bytes})
+	if len(p.buffer) > p.settings.bufferSize {
+		p.buffer = p.buffer[len(p.buffer)-p.settings.bufferSize:]
+	}
+	conn := p.conn
+	if conn == nil {
+		p.lock.Unlock()
+		return ErrDisconnected
+	}
+	var queued bool
+	if p.waitingOn == conn {
+		// only a message that may not wait gets here, and it must not be
+		// queued before the one waiting for room
+		conn.close()
+		err = ErrSlowConsumer
+	} else if queued, err = conn.trySend(bytes); err == nil && !queued && evictAfter <= 0 {
+		conn.close()
+		err = ErrSlowConsumer
+	}
+	if err != nil || queued {
+		p.lock.Unlock()
+		return p.evicted(conn, err)
+	}
+	p.waitingOn = conn
+	p.lock.Unlock()
+
+	err = conn.wait(bytes, evictAfter)
+	p.lock.Lock()
+	if p.waitingOn == conn {
+		p.waitingOn = nil
+	}
+	p.lock.Unlock()
+	return p.evicted(conn, err)
+}
+
+// evicted counts an eviction of conn, if err is one, and returns err
+func (p *WSClient) evicted(conn *outbound, err error) error {
+	if errors.Is(err, ErrSlowConsumer) {
+		p.counters.evictions.Add(1)
+		p.log.Warn("Evicted slow websocket client", "session", p.id, "queue", cap(conn.out))
+	}
+	return err
+}
+
+// reply ends the request handled by p with the handler's result or error
+func (p *WSClient) reply(r *route, res interface{}, handlerErr *Error) error {
+	replyType := r.Type
+	if r.Reply != "" && handlerErr == nil {
+		replyType = r.Reply
+	}
+	msg := &Message{Type: replyType, Payload: res}
+	if handlerErr != nil {
+		msg = &Message{Type: "error", RequestID: handlerErr.RequestID, Error: handlerErr}
+		if p.version > 1 {
+			msg.Type = replyType
+		}
+	}
+	if p.version == 1 {
+		// version 1 frames only ever came from handlers, the reply is empty
+		if res != nil || handlerErr != nil {
+			if err := p.sendMsg(msg); err != nil {
+				return err
+			}
+		}
+		return p.send(func(seq uint64) ([]byte, error) {
+			data, err := json.Marshal(&WsResp{})
+			return withFields(data, seq, p.msgID), err
+		})
+	}
+	return p.sendMsg(msg)
+}
+
+// outbound is a connection of a session. Its writer goroutine is the only one
+// writing messages to it, in the order they were queued.
+type outbound struct {
+	ws        *websocket.Conn
+	out       chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+	closeMsg  atomic.Pointer[[]byte] // close frame written once drained
+}
+
+func newOutbound(ws *websocket.Conn, queueSize int) *outbound {
+	return &outbound{
+		ws:     ws,
+		out:    make(chan []byte, queueSize),
+		closed: make(chan struct{}),
+	}
+}
+
+// send queues bytes to be written. A client whose queue stays full for
+// longer than evictAfter is too slow to keep up, and its connection is
+// closed; the session keeps the message for replay if the client resumes.
+func (o *outbound) send(bytes []byte, evictAfter time.Duration) error {
+	if queued, err := o.trySend(bytes); queued || err != nil {
+		return err
+	}
+	return o.wait(bytes, evictAfter)
+}
+
+// trySend queues bytes if there is room, and reports whether it did
+func (o *outbound) trySend(bytes []byte) (bool, error) {
+	select {
+	case o.out <- bytes:
+		return true, nil
+	case <-o.closed:
+		return false, ErrDisconnected
+	default:
+		return false, nil
+	}
+}
+
+// wait queues bytes once there is room, or evicts the client after evictAfter
+func (o *outbound) wait(bytes []byte, evictAfter time.Duration) error {
+	timer := time.NewTimer(evictAfter)
+	defer timer.Stop()
+	select {
+	case o.out <- bytes:
+		return nil
+	case <-o.closed:
+		return ErrDisconnected
+	case <-timer.C:
+		o.close()
+		return ErrSlowConsumer
+	}
+}
+
+// goAway closes the connection with a going away close frame once the
+// messages queued so far are written
+func (o *outbound) goAway(reason string) {
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseGoingAway, reason)
+	o.closeMsg.Store(&closeMsg)
+	o.drain()
+}
+
+// drain closes the connection once the messages queued so far are written
+func (o *outbound) drain() {
+	select {
+	case o.out <- nil:
+	default:
+		// the queue is full, the client would not get the rest anyway
+		o.close()
+	}
+}
+
+func (o *outbound) close() {
+	o.closeOnce.Do(func() {
+		close(o.closed)
+		o.ws.Close()
+	})
 }
+
+// writeLoop writes the queued messages of o, and pings the client between
+// them so it and the proxies on the way see the connection alive
+func (p *WSClient) writeLoop(o *outbound) {
+	pingTicker := time.NewTicker(p.settings.pingInterval)
+	defer pingTicker.Stop()
+
+	for {
+		select {
+		case bytes := <-o.out:
+			if bytes == nil {
+				if closeMsg := o.closeMsg.Load(); closeMsg != nil {
+					o.ws.WriteControl(websocket.CloseMessage, *closeMsg, time.Now().Add(1e9))
+				}
+				o.close()
+				return
+			}
+			o.ws.SetWriteDeadline(time.Now().Add(10e9))
+			if err := o.ws.WriteMessage(websocket.TextMessage, bytes); err != nil {
+				p.log.Error("Failed to write msg", "session", p.id, "error", err)
+				o.close()
+				return
+			}
+			p.latestSendTime.Store(time.Now().UnixNano())
+			p.counters.messagesOut.Add(1)
+			p.counters.bytesOut.Add(uint64(len(bytes)))
+		case <-pingTicker.C:
+			if err := o.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(10e9)); err != nil {
+				p.log.Debug("Failed to ping", "session", p.id, "error", err)
+				o.close()
+				return
+			}
+		case <-o.closed:
+			return
+		}
+	}
+}
+
+// ID identifies the session, across reconnects
+func (c *WSClient) ID() string {
+	return c.id
+}
+
+// Done is closed once the session expired
+func (c *WSClient) Done() <-chan struct{} {
+	return c.done
+}
+
 func (c *WSClient) SetContext(key string, value interface{}) {
     c.context.Store(key, value)
 }
@@ -57,80 +332,100 @@ func (c *WSClient) ClearContext(key string) {
     c.context.Delete(key)
 }
 
-func (p *WSClient) process(disconnectC chan<- *WSClient) {
-	reqC := make(chan *WsReq)
+// process reads the requests of conn until it drops, and runs their handlers
+// concurrently, up to the session's limit. Reading stops while the session
+// is at its limit.
+func (p *WSClient) process(conn *outbound, disconnectC chan<- *WSClient) {
+	reqC := make(chan *Request)
 	stop := make(chan struct{})
 
 	defer func() {
-		p.ws.Close()
+		conn.drain()
 		close(stop)
+		p.detach(conn)
 		disconnectC <- p
 	}()
 
 	go func() {
-		defer p.ws.Close() //send에서 먼저 disconnect되었을때 close를 해야 recv에서 close를 처리를 할수있다.
-		recvCount := 0
-
-		pingTicker := time.NewTicker(1e9)
-		defer pingTicker.Stop()
+		defer conn.close() //send에서 먼저 disconnect되었을때 close를 해야 recv에서 close를 처리를 할수있다.
 
 		for {
 			select {
 			case req := <-reqC:
-				recvCount++
-				if f, ok := wsHandlers[req.Type]; !ok {
-					p.log.Error("handler not existd", "type", req.Type)
-					return
-				} else if res, err := f(req.Data, p); err != nil {
-					p.log.Error("Failed handler ws request", "type", req.Type, "error", err)
-					return
-				} else {
-					if err := p.sendMsg(&WsResp{Data: res}); err != nil {
-						p.log.Error("Failed to write msg", "type", req.Type, "error", err)
-						return
-					}
-					// 채널인 경우 특별 처리
-					// if ch, ok := res.(chan types.TerminalOutput); ok {
-					// 	// 채널에서 데이터를 읽어서 전송
-					// 	for output := range ch {
-					// 		resp := &types.TerminalOutput{
-					// 			Content: output.Content,
-					// 			Done:    output.Done,
-					// 		}
-					// 		if err := p.sendMsg(resp); err != nil {
-					// 			p.log.Error("Failed to write msg", "type", req.Type, "error", err)
-					// 			return
-					// 		}
-					// 		if output.Done {
-					// 			break
-					// 		}
-					// 	}
-					// } else {
-					// 	// 일반적인 응답 처리
-					// 	if err := p.sendMsg(&WsResp{Data: res}); err != nil {
-					// 		p.log.Error("Failed to write msg", "type", req.Type, "error", err)
-					// 		return
-					// 	}
-					// }
-				}
-			case <-pingTicker.C:
-				if time.Since(p.latestSendTime) > 60e9 { //마지막 요청 이후 5초동안 아무런 요청이 없다면 연결을 끊는다.
+				select {
+				case p.handlers <- struct{}{}:
+				case <-stop:
 					return
 				}
+				go p.handle(req, conn)
 			case <-stop:
 				return
 			}
 		}
 	}()
 
+	// a client that neither answers pings nor sends anything for pongWait is gone
+	alive := func() {
+		conn.ws.SetReadDeadline(time.Now().Add(p.settings.pongWait))
+	}
+	alive()
+	conn.ws.SetPongHandler(func(string) error {
+		alive()
+		return nil
+	})
+
 	for {
-		req := (*WsReq)(nil)
-		if _, message, err := p.ws.ReadMessage(); err == nil {
-			if err := json.Unmarshal(message, &req); err == nil {
-				reqC <- req
-				continue
+		if _, message, err := conn.ws.ReadMessage(); err == nil {
+			alive()
+			p.counters.messagesIn.Add(1)
+			p.counters.bytesIn.Add(uint64(len(message)))
+			req, err := p.mux.decode(p.version, message)
+			if err == nil {
+				select {
+				case reqC <- req:
+					continue
+				case <-conn.closed:
+				}
+			} else {
+				p.log.Warn("Invalid ws request", "session", p.id, "code", err.Code, "error", err)
+				if !p.rejectRequest(req, err) {
+					continue
+				}
 			}
 		}
 		break
 	}
 }
+
+// rejectRequest answers a request that could not be decoded or routed, and
+// reports whether the error is fatal
+func (p *WSClient) rejectRequest(req *Request, err *Error) bool {
+	client := p.Session()
+	if req != nil {
+		client = p.forMessage(req.ID)
+	}
+	err = p.mux.withPolicy(err)
+	client.sendMsg(&Message{Type: "error", Error: err})
+	return err.Fatal
+}
+
+// handle runs the handler of req through the session's mux and replies with
+// its result or error, tagged with the id the client gave req. The connection
+// is dropped once a fatal error is sent.
+func (p *WSClient) handle(req *Request, conn *outbound) {
+	defer func() { <-p.handlers }()
+
+	client := p.forMessage(req.ID)
+	res, err := p.mux.serve(req, client)
+	var replyErr *Error
+	if err != nil {
+		replyErr = p.mux.withPolicy(asError(err))
+		p.log.Error("Failed handler ws request", "type", req.route.Type, "code", replyErr.Code, "fatal", replyErr.Fatal, "error", err)
+	}
+	if sendErr := client.reply(req.route, res, replyErr); sendErr != nil {
+		p.log.Error("Failed to write msg", "type", req.route.Type, "error", sendErr)
+	}
+	if replyErr != nil && replyErr.Fatal {
+		conn.drain()
+	}
+}
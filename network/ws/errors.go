@@ -0,0 +1,81 @@
+package ws
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Codes of the errors sent to clients. They are stable, clients may act on them.
+const (
+	CodeProtocol           = "PROTOCOL_ERROR"      // a frame that is not a request of the session's version
+	CodeUnknownType        = "UNKNOWN_TYPE"        // a request type no handler is registered for
+	CodeInvalidPayload     = "INVALID_PAYLOAD"     // a payload that does not decode or validate
+	CodeUnauthorized       = "UNAUTHORIZED"        // the session may not make the request
+	CodeNotFound           = "NOT_FOUND"           // the request refers to something that does not exist
+	CodeTimeout            = "TIMEOUT"             // the request could not be served in time
+	CodePaymentFailed      = "PAYMENT_FAILED"      // the request could not be paid for
+	CodePaymentPending     = "PAYMENT_PENDING"     // the payment may still land, the request is then served or refunded
+	CodeInvalidTransaction = "INVALID_TRANSACTION" // a client transaction the server refuses to relay
+	CodeUnavailable        = "UNAVAILABLE"         // the server is shutting down, retry elsewhere or later
+	CodeRateLimited        = "RATE_LIMITED"        // the session sends requests faster than it is allowed to
+	CodeInternal           = "INTERNAL"            // anything else
+)
+
+// Error is an error sent to a client. Fatal errors end the connection once
+// they are sent; see ErrorPolicy. An error about one of the client's requests
+// carries its RequestID, which the reply is tagged with.
+type Error struct {
+	Code      string      `json:"code,omitempty"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	Fatal     bool        `json:"fatal,omitempty"`
+	RequestID string      `json:"-"`
+	err       error
+}
+
+// Errorf returns an Error of code. Like fmt.Errorf, %w wraps an error.
+func Errorf(code, format string, args ...interface{}) *Error {
+	err := fmt.Errorf(format, args...)
+	return &Error{Code: code, Message: err.Error(), err: errors.Unwrap(err)}
+}
+
+// ForRequest tags e with the request it is about and returns it
+func (e *Error) ForRequest(requestID string) *Error {
+	e.RequestID = requestID
+	return e
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// asError returns err as an Error, of CodeInternal unless err wraps an Error
+func asError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return &Error{Code: CodeInternal, Message: err.Error(), err: err}
+}
+
+// ErrorPolicy decides whether an error sent to a client ends its connection.
+// The session itself survives, and may be resumed on a new connection.
+type ErrorPolicy func(*Error) bool
+
+// DefaultErrorPolicy only gives up on clients that do not speak the protocol,
+// whose next frames cannot be trusted to be requests either. Every other
+// error concerns a single request, and the client may go on with others.
+func DefaultErrorPolicy(e *Error) bool {
+	return e.Code == CodeProtocol
+}
+
+// withPolicy returns a copy of e marked fatal if policy says so
+func withPolicy(policy ErrorPolicy, e *Error) *Error {
+	marked := *e
+	marked.Fatal = policy(e)
+	return &marked
+}
@@ -1,30 +1,149 @@
 package ws
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"sync"
 )
 
-type tyHandler func(interface{}, *WSClient) (interface{}, error)
+// Route names a request type. Type is its name in version 2, Legacy its
+// number in version 1. The reply ending the request is of type Reply, or of
+// Type when Reply is empty.
+type Route struct {
+	Type   string
+	Legacy WsType
+	Reply  string
+}
+
+// Validator is implemented by requests that check their payload once decoded
+type Validator interface {
+	Validate() error
+}
+
+// Empty is the request or reply of handlers that take or return nothing
+type Empty struct{}
+
+// Handler handles a decoded and validated request. Its reply ends the
+// request, a nil reply ends it without payload.
+type Handler[Req, Resp any] func(*Req, *WSClient) (*Resp, error)
+
+// HandlerFunc is a handler as middleware sees it, before its payload is decoded
+type HandlerFunc func(req *Request, client *WSClient) (interface{}, error)
+
+// Middleware wraps the handling of every request of a Mux
+type Middleware func(next HandlerFunc) HandlerFunc
 
-var wsHandlers = make(map[WsType]tyHandler)
+type route struct {
+	Route
+	run HandlerFunc
+}
+
+// Mux routes the requests of the sessions of a hub to their handlers, through
+// its middleware. Every hub has its own, so hubs may serve different requests.
+type Mux struct {
+	lock        sync.RWMutex
+	routes      map[string]*route
+	legacy      map[WsType]*route
+	middleware  []Middleware
+	errorPolicy ErrorPolicy
+}
 
-func AddHandler(handlerType WsType, handler tyHandler) error {
-	if _, ok := wsHandlers[handlerType]; ok {
-		return fmt.Errorf("ws handler type %d already existed ", handlerType)
+func NewMux() *Mux {
+	return &Mux{
+		routes:      make(map[string]*route),
+		legacy:      make(map[WsType]*route),
+		errorPolicy: DefaultErrorPolicy,
 	}
+}
 
-	wsHandlers[handlerType] = handler
+// Use appends middleware, the first one added is the outermost
+func (m *Mux) Use(middleware ...Middleware) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.middleware = append(m.middleware, middleware...)
+}
 
-	return nil
+// SetErrorPolicy replaces the policy deciding which errors are fatal
+func (m *Mux) SetErrorPolicy(policy ErrorPolicy) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.errorPolicy = policy
 }
 
-func VerifyRequest(v, r interface{}) error {
-	if bytes, err := json.Marshal(v); err != nil {
-		return err
-	} else if err := json.Unmarshal(bytes, r); err != nil {
-		return err
+// AddHandler registers the handler of the requests of r on m. The payload is
+// decoded into a Req, unknown fields rejected, and validated before handler
+// runs.
+func AddHandler[Req, Resp any](m *Mux, r Route, handler Handler[Req, Resp]) error {
+	h := &route{Route: r}
+	h.run = func(req *Request, client *WSClient) (interface{}, error) {
+		payload := new(Req)
+		if err := decodePayload(req.Payload, payload); err != nil {
+			return nil, Errorf(CodeInvalidPayload, "invalid %s payload: %v", r.Type, err)
+		}
+		if v, ok := interface{}(payload).(Validator); ok {
+			if err := v.Validate(); err != nil {
+				return nil, Errorf(CodeInvalidPayload, "invalid %s payload: %v", r.Type, err)
+			}
+		}
+		resp, err := handler(payload, client)
+		if err != nil || resp == nil {
+			return nil, err
+		}
+		return resp, nil
 	}
 
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.routes[r.Type]; ok {
+		return fmt.Errorf("ws handler type %s already existed ", r.Type)
+	}
+	if _, ok := m.legacy[r.Legacy]; ok {
+		return fmt.Errorf("ws handler type %d already existed ", r.Legacy)
+	}
+	m.routes[r.Type] = h
+	m.legacy[r.Legacy] = h
 	return nil
 }
+
+func (m *Mux) route(msgType string) (*route, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	r, ok := m.routes[msgType]
+	return r, ok
+}
+
+func (m *Mux) legacyRoute(msgType WsType) (*route, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	r, ok := m.legacy[msgType]
+	return r, ok
+}
+
+// serve runs the handler of a routed request through the middleware
+func (m *Mux) serve(req *Request, client *WSClient) (interface{}, error) {
+	m.lock.RLock()
+	next := req.route.run
+	for i := len(m.middleware) - 1; i >= 0; i-- {
+		next = m.middleware[i](next)
+	}
+	m.lock.RUnlock()
+	return next(req, client)
+}
+
+// withPolicy returns a copy of e marked fatal if the mux's policy says so
+func (m *Mux) withPolicy(e *Error) *Error {
+	m.lock.RLock()
+	policy := m.errorPolicy
+	m.lock.RUnlock()
+	return withPolicy(policy, e)
+}
+
+func decodePayload(payload json.RawMessage, req interface{}) error {
+	if len(payload) == 0 || bytes.Equal(payload, []byte("null")) {
+		payload = []byte("{}")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(req)
+}
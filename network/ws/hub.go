@@ -2,20 +2,64 @@ package ws
 
 import (
 	"net/http"
+	"strconv"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"github.com/router/config"
 )
 
+const (
+	defaultSessionTTL    = 5 * time.Minute
+	defaultBufferSize    = 256
+	defaultMaxConcurrent = 4
+	defaultPingInterval  = 20 * time.Second
+	defaultPongWait      = 60 * time.Second
+	defaultQueueSize     = 64
+	defaultSlowConsumer  = 5 * time.Second
+)
+
+// settings are the limits of every session of a hub
+type settings struct {
+	bufferSize    int
+	maxConcurrent int
+	pingInterval  time.Duration
+	pongWait      time.Duration
+	queueSize     int
+	slowConsumer  time.Duration
+}
+
 type WSHub struct {
 	upgrader        *websocket.Upgrader
-	connectC        chan *WSClient
+	connectC        chan *connection
 	disconnectC     chan *WSClient
 	countLiveSocket int64
+	closing         atomic.Bool
+
+	sessionTTL   time.Duration
+	settings     *settings
+	mux          *Mux
+	counters     hubCounters
+	sessionsLock sync.Mutex
+	sessions     map[string]*WSClient            // by id
+	wallets      map[string]map[string]*WSClient // by authenticated wallet, then id
 }
 
-func NewWsHub() *WSHub {
+// connection is a new connection of a session
+type connection struct {
+	client *WSClient
+	conn   *outbound
+}
+
+// NewWsHub creates a hub whose sessions' requests are routed by mux, a new
+// empty one if nil
+func NewWsHub(cfg config.WebSocket, mux *Mux) *WSHub {
+	if mux == nil {
+		mux = NewMux()
+	}
 	r := &WSHub{
 		upgrader: &websocket.Upgrader{
 			ReadBufferSize:  1 << 20,
@@ -24,24 +68,121 @@ func NewWsHub() *WSHub {
 				return true
 			},
 		},
-		connectC:    make(chan *WSClient, 1000),
+		connectC:    make(chan *connection, 1000),
 		disconnectC: make(chan *WSClient, 1000),
+		sessionTTL:  defaultSessionTTL,
+		mux:         mux,
+		settings: &settings{
+			bufferSize:    defaultBufferSize,
+			maxConcurrent: defaultMaxConcurrent,
+			pingInterval:  defaultPingInterval,
+			pongWait:      defaultPongWait,
+			queueSize:     defaultQueueSize,
+			slowConsumer:  defaultSlowConsumer,
+		},
+		sessions: make(map[string]*WSClient),
+		wallets:  make(map[string]map[string]*WSClient),
+	}
+	if cfg.SessionTTLSeconds > 0 {
+		r.sessionTTL = time.Duration(cfg.SessionTTLSeconds) * time.Second
+	}
+	if cfg.BufferSize > 0 {
+		r.settings.bufferSize = cfg.BufferSize
+	}
+	if cfg.MaxConcurrent > 0 {
+		r.settings.maxConcurrent = cfg.MaxConcurrent
+	}
+	if cfg.PingSeconds > 0 {
+		r.settings.pingInterval = time.Duration(cfg.PingSeconds) * time.Second
+	}
+	if cfg.PongWaitSeconds > 0 {
+		r.settings.pongWait = time.Duration(cfg.PongWaitSeconds) * time.Second
+	}
+	if r.settings.pingInterval >= r.settings.pongWait {
+		// a client has to be pinged before it is given up on
+		r.settings.pingInterval = r.settings.pongWait * 9 / 10
+	}
+	if cfg.QueueSize > 0 {
+		r.settings.queueSize = cfg.QueueSize
+	}
+	if cfg.SlowConsumerSeconds > 0 {
+		r.settings.slowConsumer = time.Duration(cfg.SlowConsumerSeconds) * time.Second
 	}
 	go r.loop()
 	return r
 }
 
+// Mux routes the requests of the hub's sessions, handlers are added to it
+func (p *WSHub) Mux() *Mux {
+	return p.mux
+}
+
+// AddClient upgrades the request to a websocket connection of a session. A
+// client reconnecting passes the "session" and "token" it was given in its
+// session frame, and the "last_seq" it received, to resume its session and
+// be replayed what it missed. Any other connection opens a new session,
+// speaking the protocol version negotiated with the "version" parameter.
 func (p *WSHub) AddClient(c *gin.Context) (*WSClient, error) {
-	if ws, err := p.upgrader.Upgrade(c.Writer, c.Request, nil); err != nil {
+	if p.closing.Load() {
+		return nil, ErrShuttingDown
+	}
+	version, err := negotiateVersion(c.Query("version"))
+	if err != nil {
+		return nil, err
+	}
+	ws, err := p.upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
 		return nil, err
+	}
+
+	client, resumed := p.resumable(c.Query("session"), c.Query("token"), version)
+	if !resumed {
+		if client, err = newWsClient(version, p.settings, p.mux); err != nil {
+			ws.Close()
+			return nil, err
+		}
+		p.register(client)
 	} else {
-		client := newWsClient(ws)
-		p.connectC <- client
-		return client, nil
+		p.counters.resumed.Add(1)
+	}
+	lastSeq, _ := strconv.ParseUint(c.Query("last_seq"), 10, 64)
+	conn, err := client.attach(ws, resumed, lastSeq)
+	if err != nil {
+		ws.Close()
+		return nil, err
+	}
+	p.connectC <- &connection{client: client, conn: conn}
+	return client, nil
+}
+
+// resumable returns the live session of id if token is its token, and it
+// speaks version
+func (p *WSHub) resumable(id, token string, version int) (*WSClient, bool) {
+	if id == "" || token == "" {
+		return nil, false
+	}
+	p.sessionsLock.Lock()
+	defer p.sessionsLock.Unlock()
+	client, ok := p.sessions[id]
+	if !ok || !client.validToken(token) || client.version != version || client.expired(p.sessionTTL) {
+		return nil, false
 	}
+	return client, true
 }
 
-func (p *WSHub) SendToClient(client *WSClient, message interface{}) error {
+// expireSessions ends the sessions whose client has been away for too long
+func (p *WSHub) expireSessions() {
+	p.sessionsLock.Lock()
+	defer p.sessionsLock.Unlock()
+	for _, client := range p.sessions {
+		if client.expired(p.sessionTTL) {
+			p.unregister(client)
+			close(client.done)
+		}
+	}
+}
+
+func (p *WSHub) SendToClient(client *WSClient, message *Message) error {
     return client.sendMsg(message)
 }
 
@@ -52,12 +193,18 @@ func (p *WSHub) GetLiveSocketCount() int64 {
 
 
 func (p *WSHub) loop() {
+	expireTicker := time.NewTicker(p.sessionTTL / 4)
+	defer expireTicker.Stop()
+
 	for {
 		select {
-		case client := <-p.connectC:
-			go client.process(p.disconnectC)
+		case c := <-p.connectC:
+			go c.client.process(c.conn, p.disconnectC)
 			atomic.AddInt64(&p.countLiveSocket, 1)
 
+		case <-expireTicker.C:
+			p.expireSessions()
+
 		case <-p.disconnectC:
 			atomic.AddInt64(&p.countLiveSocket, -1)
 		}
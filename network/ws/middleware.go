@@ -0,0 +1,115 @@
+package ws
+
+import (
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/router/common/log"
+)
+
+// Recovery answers the requests whose handler panics with an internal error
+// instead of taking the server down
+func Recovery() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(req *Request, client *WSClient) (res interface{}, err error) {
+			defer func() {
+				if v := recover(); v != nil {
+					client.log.Error("Ws handler panicked", "session", client.id, "type", req.Route.Type, "panic", v, "stack", string(debug.Stack()))
+					res, err = nil, Errorf(CodeInternal, "internal error")
+				}
+			}()
+			return next(req, client)
+		}
+	}
+}
+
+// Logging logs every request with how long it took and how it ended
+func Logging(logger log.Logger) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(req *Request, client *WSClient) (interface{}, error) {
+			start := time.Now()
+			res, err := next(req, client)
+			if err != nil {
+				logger.Debug("Ws request failed", "session", client.id, "type", req.Route.Type, "code", asError(err).Code, "elapsed", time.Since(start))
+			} else {
+				logger.Debug("Ws request served", "session", client.id, "type", req.Route.Type, "elapsed", time.Since(start))
+			}
+			return res, err
+		}
+	}
+}
+
+// Auth refuses the requests of sessions not authorized, but for the request
+// types public, such as those authenticating the session
+func Auth(authorized func(*WSClient) bool, public ...string) Middleware {
+	open := make(map[string]bool, len(public))
+	for _, t := range public {
+		open[t] = true
+	}
+	return func(next HandlerFunc) HandlerFunc {
+		return func(req *Request, client *WSClient) (interface{}, error) {
+			if !open[req.Route.Type] && !authorized(client) {
+				return nil, Errorf(CodeUnauthorized, "%s requires an authenticated session", req.Route.Type)
+			}
+			return next(req, client)
+		}
+	}
+}
+
+// RateLimit allows each session perSecond requests on average, in bursts of
+// up to burst requests
+func RateLimit(perSecond float64, burst int) Middleware {
+	l := &limiter{rate: perSecond, burst: float64(burst), buckets: make(map[string]*bucket)}
+	return func(next HandlerFunc) HandlerFunc {
+		return func(req *Request, client *WSClient) (interface{}, error) {
+			if !l.allow(client) {
+				return nil, Errorf(CodeRateLimited, "too many requests, at most %g per second", l.rate)
+			}
+			return next(req, client)
+		}
+	}
+}
+
+// limiter is a token bucket per session
+type limiter struct {
+	rate  float64
+	burst float64
+
+	lock    sync.Mutex
+	buckets map[string]*bucket // by session id
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (l *limiter) allow(client *WSClient) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[client.id]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client.id] = b
+		// forget the session once it expires
+		go func(id string, done <-chan struct{}) {
+			<-done
+			l.lock.Lock()
+			delete(l.buckets, id)
+			l.lock.Unlock()
+		}(client.id, client.done)
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
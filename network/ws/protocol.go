@@ -1,12 +1,158 @@
 package ws
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Protocol versions a client may negotiate on connect with the "version"
+// query parameter. Clients that do not ask for one speak version 1.
+//
+// Version 1 requests are {"id", "type": <number>, "data"}. The handler's
+// frames are {"type", "payload", "request_id"}, and every request ends with
+// {"data"}.
+//
+// Version 2 requests and frames are Envelopes, and every request ends with an
+// envelope of its type, or of its route's reply type, carrying the handler's
+// reply or error.
+const (
+	MinProtocolVersion = 1
+	ProtocolVersion    = 2
+)
+
+// ErrUnsupportedVersion is returned by AddClient to clients asking for a
+// protocol version older than the server supports
+var ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+// negotiateVersion picks the version to speak with a client asking for
+// requested, the newest the server knows at most
+func negotiateVersion(requested string) (int, error) {
+	if requested == "" {
+		return MinProtocolVersion, nil
+	}
+	version, err := strconv.Atoi(requested)
+	if err != nil || version < MinProtocolVersion {
+		return 0, fmt.Errorf("%w %q, the server speaks %d to %d", ErrUnsupportedVersion, requested, MinProtocolVersion, ProtocolVersion)
+	}
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	return version, nil
+}
+
 type WsType int
 
+// WsReq is a version 1 request
 type WsReq struct {
-	Type WsType      `json:"type"`
-	Data interface{} `json:"data"`
+	ID   json.RawMessage `json:"id"` // echoed in every message sent while handling the request
+	Type WsType          `json:"type"`
+	Data json.RawMessage `json:"data"`
 }
 
+// WsResp is the version 1 reply ending a request
 type WsResp struct {
 	Data interface{} `json:"data"`
 }
+
+// Envelope is every request and frame of version 2
+type Envelope struct {
+	Version   int             `json:"version"`
+	Seq       uint64          `json:"seq,omitempty"` // frames only, see the session frame
+	ID        json.RawMessage `json:"id,omitempty"`  // set by the client, echoed while handling its request
+	Type      string          `json:"type"`
+	RequestID string          `json:"request_id,omitempty"` // the geo request a frame is about
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	Error     *Error          `json:"error,omitempty"`
+}
+
+// Message is a frame sent to a client, encoded in the session's version
+type Message struct {
+	Type      string
+	RequestID string
+	Payload   interface{}
+	Error     *Error
+}
+
+// legacyFrame is a version 1 frame
+type legacyFrame struct {
+	Type      string      `json:"type"`
+	Payload   interface{} `json:"payload"`
+	RequestID string      `json:"request_id,omitempty"`
+}
+
+// encode renders msg in version, with the frame's sequence number and the id
+// of the request being handled
+func encode(version int, msg *Message, seq uint64, id json.RawMessage) ([]byte, error) {
+	if version == 1 {
+		payload := msg.Payload
+		if payload == nil && msg.Error != nil {
+			payload = msg.Error.Message
+			if msg.Error.Details != nil {
+				payload = msg.Error.Details
+			}
+		}
+		data, err := json.Marshal(&legacyFrame{Type: msg.Type, Payload: payload, RequestID: msg.RequestID})
+		if err != nil {
+			return nil, err
+		}
+		return withFields(data, seq, id), nil
+	}
+
+	env := &Envelope{
+		Version:   version,
+		Seq:       seq,
+		ID:        id,
+		Type:      msg.Type,
+		RequestID: msg.RequestID,
+		Error:     msg.Error,
+	}
+	if msg.Payload != nil {
+		payload, err := json.Marshal(msg.Payload)
+		if err != nil {
+			return nil, err
+		}
+		env.Payload = payload
+	}
+	return json.Marshal(env)
+}
+
+// Request is a decoded request of any version, as middleware sees it
+type Request struct {
+	ID      json.RawMessage // set by the client
+	Route   Route
+	Payload json.RawMessage // not yet decoded, the handler decodes it
+	route   *route
+}
+
+// decode parses a request of version and finds its route in m. The request
+// is returned with the error when it could be parsed, so it can be answered.
+func (m *Mux) decode(version int, message []byte) (*Request, *Error) {
+	if version == 1 {
+		req := new(WsReq)
+		if err := json.Unmarshal(message, req); err != nil {
+			return nil, Errorf(CodeProtocol, "malformed request: %v", err)
+		}
+		r, ok := m.legacyRoute(req.Type)
+		if !ok {
+			return &Request{ID: req.ID}, Errorf(CodeUnknownType, "unknown request type %d", req.Type)
+		}
+		return &Request{ID: req.ID, Route: r.Route, Payload: req.Data, route: r}, nil
+	}
+
+	env := new(Envelope)
+	if err := json.Unmarshal(message, env); err != nil {
+		return nil, Errorf(CodeProtocol, "malformed request: %v", err)
+	}
+	req := &Request{ID: env.ID, Payload: env.Payload}
+	if env.Version != version {
+		return req, Errorf(CodeProtocol, "request of version %d on a version %d session", env.Version, version)
+	}
+	r, ok := m.route(env.Type)
+	if !ok {
+		return req, Errorf(CodeUnknownType, "unknown request type %q", env.Type)
+	}
+	req.Route, req.route = r.Route, r
+	return req, nil
+}
@@ -0,0 +1,149 @@
+package ws
+
+import (
+	"errors"
+)
+
+// ErrNoSession is returned by sends to a session or wallet the hub does not know
+var ErrNoSession = errors.New("no such websocket session")
+
+// ErrShuttingDown is returned by AddClient once the hub is shutting down
+var ErrShuttingDown = errors.New("websocket hub shutting down")
+
+// register adds a new session to the hub
+func (p *WSHub) register(client *WSClient) {
+	p.sessionsLock.Lock()
+	defer p.sessionsLock.Unlock()
+	p.sessions[client.ID()] = client
+	p.counters.opened.Add(1)
+}
+
+// unregister removes an expired session, the lock must be held
+func (p *WSHub) unregister(client *WSClient) {
+	delete(p.sessions, client.ID())
+	p.unbindWallet(client)
+	p.counters.expired.Add(1)
+}
+
+// BindWallet indexes the session of client under the wallet it authenticated
+// with, replacing any wallet it authenticated with before
+func (p *WSHub) BindWallet(client *WSClient, wallet string) {
+	p.sessionsLock.Lock()
+	defer p.sessionsLock.Unlock()
+	if _, ok := p.sessions[client.ID()]; !ok {
+		return
+	}
+	p.unbindWallet(client)
+	client.wallet = wallet
+	if p.wallets[wallet] == nil {
+		p.wallets[wallet] = make(map[string]*WSClient)
+	}
+	p.wallets[wallet][client.ID()] = client
+}
+
+// unbindWallet removes client from the wallet index, the lock must be held
+func (p *WSHub) unbindWallet(client *WSClient) {
+	if client.wallet == "" {
+		return
+	}
+	delete(p.wallets[client.wallet], client.ID())
+	if len(p.wallets[client.wallet]) == 0 {
+		delete(p.wallets, client.wallet)
+	}
+	client.wallet = ""
+}
+
+// Client returns the live session of id
+func (p *WSHub) Client(id string) (*WSClient, bool) {
+	p.sessionsLock.Lock()
+	defer p.sessionsLock.Unlock()
+	client, ok := p.sessions[id]
+	if !ok {
+		return nil, false
+	}
+	return client.Session(), true
+}
+
+// SendToSession sends message to the session of id. A session whose client
+// is away keeps the message for replay, and ErrDisconnected is returned.
+func (p *WSHub) SendToSession(id string, message *Message) error {
+	client, ok := p.Client(id)
+	if !ok {
+		return ErrNoSession
+	}
+	return client.sendMsg(message)
+}
+
+// SendToWallet sends message to every session authenticated with wallet and
+// returns how many it was written or queued to
+func (p *WSHub) SendToWallet(wallet string, message *Message) (int, error) {
+	p.sessionsLock.Lock()
+	clients := make([]*WSClient, 0, len(p.wallets[wallet]))
+	for _, client := range p.wallets[wallet] {
+		clients = append(clients, client.Session())
+	}
+	p.sessionsLock.Unlock()
+
+	if len(clients) == 0 {
+		return 0, ErrNoSession
+	}
+	return sendAll(clients, message)
+}
+
+// Broadcast sends message to every live session and returns how many it was
+// written or queued to
+func (p *WSHub) Broadcast(message *Message) (int, error) {
+	p.sessionsLock.Lock()
+	clients := make([]*WSClient, 0, len(p.sessions))
+	for _, client := range p.sessions {
+		clients = append(clients, client.Session())
+	}
+	p.sessionsLock.Unlock()
+	return sendAll(clients, message)
+}
+
+// sendAll sends message to clients without waiting on any, see fanOutMsg.
+// Sessions whose client is away keep it for replay and are not counted; the
+// first other error is returned.
+func sendAll(clients []*WSClient, message *Message) (int, error) {
+	sent := 0
+	var firstErr error
+	for _, client := range clients {
+		err := client.fanOutMsg(message)
+		switch {
+		case err == nil:
+			sent++
+		case errors.Is(err, ErrDisconnected):
+		case firstErr == nil:
+			firstErr = err
+		}
+	}
+	return sent, firstErr
+}
+
+// Shutdown refuses new connections and tells every connected client the
+// server is going away, so they stop starting requests. The connections stay
+// open for the requests in flight to finish; see Close.
+func (p *WSHub) Shutdown(reason string) int {
+	p.closing.Store(true)
+	sent, _ := p.Broadcast(&Message{Type: "goingAway", Payload: map[string]interface{}{"reason": reason}})
+	return sent
+}
+
+// Close closes every connection with a going away close frame, once the
+// messages queued to it are written
+func (p *WSHub) Close(reason string) {
+	p.closing.Store(true)
+	p.sessionsLock.Lock()
+	defer p.sessionsLock.Unlock()
+	for _, client := range p.sessions {
+		client.lock.Lock()
+		if client.conn != nil {
+			client.conn.goAway(reason)
+		}
+		if client.attaching != nil {
+			client.attaching.goAway(reason)
+		}
+		client.lock.Unlock()
+	}
+}
@@ -0,0 +1,178 @@
+package ws
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// maxMessageSize bounds the requests a client may send. A signedTx request
+// carries a base64 transaction of up to 1232 bytes, 1644 characters encoded,
+// plus its envelope.
+const maxMessageSize = 4 << 10
+
+// ErrDisconnected is returned by sends to a session whose client is away. The
+// message is kept and replayed if the client resumes the session in time.
+var ErrDisconnected = errors.New("websocket client disconnected")
+
+// ErrSlowConsumer is returned by sends to a client that does not read its
+// messages fast enough, whose connection was closed for it
+var ErrSlowConsumer = errors.New("websocket client too slow, evicted")
+
+type bufferedMsg struct {
+	seq  uint64
+	data []byte
+}
+
+// SessionInfo is the payload of the "session" frame a client gets on every
+// connect. Seq is the sequence number of the last message of the session;
+// Missed is set on a resume when messages after the client's last_seq were
+// already dropped from the buffer and cannot be replayed.
+type SessionInfo struct {
+	Version int    `json:"version"`
+	Session string `json:"session"`
+	Token   string `json:"token"`
+	Seq     uint64 `json:"seq"`
+	Resumed bool   `json:"resumed"`
+	Missed  bool   `json:"missed"`
+}
+
+func newSessionToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate session token: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// withFields adds the "seq" field, and the "id" field when id is set, to a
+// json object
+func withFields(data []byte, seq uint64, id json.RawMessage) []byte {
+	if len(data) < 2 || data[0] != '{' {
+		return data
+	}
+	fields := `{"seq":` + strconv.FormatUint(seq, 10)
+	if len(id) > 0 {
+		fields += `,"id":` + string(id)
+	}
+	if bytes.Equal(bytes.TrimSpace(data[1:]), []byte("}")) {
+		return []byte(fields + "}")
+	}
+	return append([]byte(fields+","), data[1:]...)
+}
+
+func (p *WSClient) validToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(p.token)) == 1
+}
+
+// attach makes ws the session's connection, dropping the previous one if
+// the client reconnected before it was noticed gone. The client is sent the
+// session frame, then on a resume every buffered message after lastSeq.
+func (p *WSClient) attach(ws *websocket.Conn, resumed bool, lastSeq uint64) (*outbound, error) {
+	ws.SetReadLimit(maxMessageSize)
+	conn := newOutbound(ws, p.settings.queueSize)
+	go p.writeLoop(conn)
+
+	p.lock.Lock()
+	if p.conn != nil {
+		p.conn.close()
+		p.conn = nil
+	}
+	p.attaching = conn
+	p.disconnectedAt = time.Time{}
+	p.latestSendTime.Store(time.Now().UnixNano())
+	var replay []bufferedMsg
+	if resumed {
+		replay = p.bufferedAfter(lastSeq)
+	}
+	info := &SessionInfo{
+		Version: p.version,
+		Session: p.id,
+		Token:   p.token,
+		Seq:     p.seq,
+		Resumed: resumed,
+		Missed:  resumed && lastSeq < p.seq && (len(replay) == 0 || replay[0].seq > lastSeq+1),
+	}
+	p.lock.Unlock()
+
+	fail := func(err error) (*outbound, error) {
+		conn.close()
+		p.lock.Lock()
+		if p.attaching == conn {
+			p.attaching = nil
+			p.disconnectedAt = time.Now()
+		}
+		p.lock.Unlock()
+		return nil, err
+	}
+	frame, err := encode(p.version, &Message{Type: "session", Payload: info}, 0, nil)
+	if err != nil {
+		return fail(err)
+	}
+	if err := conn.send(frame, p.settings.slowConsumer); err != nil {
+		return fail(err)
+	}
+	// a slow client may block the sends, so they are made without the lock.
+	// Messages sent to the session meanwhile are only buffered, and are sent
+	// after the replay until none is left, keeping them in order.
+	sent := info.Seq
+	for {
+		for _, msg := range replay {
+			if err := conn.send(msg.data, p.settings.slowConsumer); err != nil {
+				return fail(err)
+			}
+		}
+		p.lock.Lock()
+		if p.attaching != conn {
+			// a newer connection of the client took over
+			p.lock.Unlock()
+			conn.close()
+			return nil, ErrDisconnected
+		}
+		replay = p.bufferedAfter(sent)
+		if len(replay) == 0 {
+			p.conn, p.attaching = conn, nil
+			p.lock.Unlock()
+			return conn, nil
+		}
+		sent = replay[len(replay)-1].seq
+		p.lock.Unlock()
+	}
+}
+
+// bufferedAfter returns the buffered messages after seq. Callers must hold lock.
+func (p *WSClient) bufferedAfter(seq uint64) []bufferedMsg {
+	var msgs []bufferedMsg
+	for _, msg := range p.buffer {
+		if msg.seq > seq {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
+// detach forgets conn once it dropped, unless the session already moved on
+// to a newer connection
+func (p *WSClient) detach(conn *outbound) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.conn == conn {
+		p.conn = nil
+		p.disconnectedAt = time.Now()
+	}
+}
+
+// expired reports whether the client has been away for longer than ttl
+func (p *WSClient) expired(ttl time.Duration) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.conn == nil && !p.disconnectedAt.IsZero() && time.Since(p.disconnectedAt) > ttl
+}
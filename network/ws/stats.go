@@ -0,0 +1,101 @@
+package ws
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// counters of a session, over all its connections
+type counters struct {
+	bytesIn     atomic.Uint64
+	bytesOut    atomic.Uint64
+	messagesIn  atomic.Uint64
+	messagesOut atomic.Uint64
+	evictions   atomic.Uint64
+}
+
+// ClientStats are the counters of a session
+type ClientStats struct {
+	Session     string    `json:"session"`
+	Wallet      string    `json:"wallet,omitempty"`
+	Connected   bool      `json:"connected"`
+	BytesIn     uint64    `json:"bytes_in"`
+	BytesOut    uint64    `json:"bytes_out"`
+	MessagesIn  uint64    `json:"messages_in"`
+	MessagesOut uint64    `json:"messages_out"`
+	Evictions   uint64    `json:"evictions"`   // connections closed for reading too slowly
+	QueueDepth  int       `json:"queue_depth"` // messages waiting to be written
+	QueueSize   int       `json:"queue_size"`
+	LastSend    time.Time `json:"last_send"`
+}
+
+func (p *WSClient) Stats() ClientStats {
+	stats := ClientStats{
+		Session:     p.id,
+		BytesIn:     p.counters.bytesIn.Load(),
+		BytesOut:    p.counters.bytesOut.Load(),
+		MessagesIn:  p.counters.messagesIn.Load(),
+		MessagesOut: p.counters.messagesOut.Load(),
+		Evictions:   p.counters.evictions.Load(),
+		QueueSize:   p.settings.queueSize,
+		LastSend:    time.Unix(0, p.latestSendTime.Load()),
+	}
+	p.lock.Lock()
+	if p.conn != nil {
+		stats.Connected = true
+		stats.QueueDepth = len(p.conn.out)
+	}
+	p.lock.Unlock()
+	return stats
+}
+
+// counters of a hub
+type hubCounters struct {
+	opened  atomic.Uint64
+	resumed atomic.Uint64
+	expired atomic.Uint64
+}
+
+// HubStats are the counters of a hub
+type HubStats struct {
+	LiveSockets     int64  `json:"live_sockets"`
+	Sessions        int    `json:"sessions"`
+	Wallets         int    `json:"wallets"` // authenticated wallets with a live session
+	SessionsOpened  uint64 `json:"sessions_opened"`
+	SessionsResumed uint64 `json:"sessions_resumed"`
+	SessionsExpired uint64 `json:"sessions_expired"`
+}
+
+func (p *WSHub) Stats() HubStats {
+	p.sessionsLock.Lock()
+	sessions, wallets := len(p.sessions), len(p.wallets)
+	p.sessionsLock.Unlock()
+	return HubStats{
+		LiveSockets:     p.GetLiveSocketCount(),
+		Sessions:        sessions,
+		Wallets:         wallets,
+		SessionsOpened:  p.counters.opened.Load(),
+		SessionsResumed: p.counters.resumed.Load(),
+		SessionsExpired: p.counters.expired.Load(),
+	}
+}
+
+// ClientStats returns the counters of every live session
+func (p *WSHub) ClientStats() []ClientStats {
+	p.sessionsLock.Lock()
+	clients := make([]*WSClient, 0, len(p.sessions))
+	wallets := make([]string, 0, len(p.sessions))
+	for _, client := range p.sessions {
+		clients = append(clients, client)
+		wallets = append(wallets, client.wallet)
+	}
+	p.sessionsLock.Unlock()
+
+	stats := make([]ClientStats, 0, len(clients))
+	for i, client := range clients {
+		s := client.Stats()
+		s.Wallet = wallets[i]
+		stats = append(stats, s)
+	}
+	return stats
+}
@@ -0,0 +1,72 @@
+package router
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/router/config"
+)
+
+// adminAccess decides who may call the admin apis, which expose client
+// wallets, refunds and sessions
+type adminAccess struct {
+	token   string
+	allowed []*net.IPNet
+}
+
+func newAdminAccess(cfg config.Admin) (*adminAccess, error) {
+	a := &adminAccess{token: cfg.Token}
+	allow := cfg.AllowIPs
+	if len(allow) == 0 && cfg.Token == "" {
+		allow = []string{"127.0.0.0/8", "::1/128"}
+	}
+	for _, s := range allow {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid admin allowed address %s: %v", s, err)
+		}
+		a.allowed = append(a.allowed, network)
+	}
+	return a, nil
+}
+
+// authorize checks the admin token, if one is configured, and that the
+// caller's address is allowed, if an allow-list is. The address is the peer's,
+// forwarding headers are not trusted.
+func (a *adminAccess) authorize(c *gin.Context) {
+	if a.token != "" {
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid admin token"})
+			return
+		}
+	}
+	if len(a.allowed) > 0 && !a.allows(net.ParseIP(c.RemoteIP())) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "address not allowed"})
+		return
+	}
+	c.Next()
+}
+
+func (a *adminAccess) allows(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range a.allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
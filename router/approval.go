@@ -0,0 +1,267 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	bin "github.com/gagliardetto/binary"
+	"github.com/gagliardetto/solana-go"
+	"github.com/gagliardetto/solana-go/programs/token"
+	"github.com/gagliardetto/solana-go/rpc"
+	solclient "github.com/router/network/solana"
+	"github.com/router/types"
+)
+
+const (
+	// how long to wait for a transaction to confirm when its blockhash does not expire first
+	confirmTimeout = 2 * time.Minute
+	// how long to wait before asking again for the status of an approval
+	confirmRetryDelay = 2 * time.Second
+)
+
+// confirmApproval waits for the approval or escrow payment submitted for
+// record to confirm. Rpc errors are retried until ctx is done, so an error
+// for which approvalFailed is false means the transaction may still land.
+func (r *Router) confirmApproval(ctx context.Context, record *types.RequestRecord) error {
+	for {
+		_, err := r.solanaClient.ConfirmTransaction(ctx, record.ApprovalTx, rpc.CommitmentConfirmed, record.LastValidBlockHeight)
+		if err == nil || approvalFailed(err) || ctx.Err() != nil {
+			return err
+		}
+		r.log.Warn("Failed to confirm approval, retrying", "request_id", record.RequestID, "tx", record.ApprovalTx, "error", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(confirmRetryDelay):
+		}
+	}
+}
+
+// approvalFailed reports whether err of confirmApproval means the transaction
+// failed on chain or can no longer land
+func approvalFailed(err error) bool {
+	var txErr *solclient.TransactionError
+	return errors.As(err, &txErr) || errors.Is(err, solclient.ErrBlockhashExpired)
+}
+
+// buildApprovalTx builds the transaction the client signs to approve the
+// router as delegate of the request's price on the client's token account.
+// The client's wallet pays the fee. The message is kept in the record so the
+// signed transaction can be checked against it.
+func (r *Router) buildApprovalTx(record *types.RequestRecord) (string, error) {
+	wallet, err := solana.PublicKeyFromBase58(record.Wallet)
+	if err != nil {
+		return "", fmt.Errorf("invalid wallet: %v", err)
+	}
+	mint, err := solana.PublicKeyFromBase58(record.Mint)
+	if err != nil {
+		return "", fmt.Errorf("invalid mint: %v", err)
+	}
+	source, _, err := solana.FindAssociatedTokenAddress(wallet, mint)
+	if err != nil {
+		return "", fmt.Errorf("failed to get associated token address: %v", err)
+	}
+
+	latest, err := r.solanaClient.GetLatestBlockhash(context.Background())
+	if err != nil {
+		return "", err
+	}
+	tx, err := solana.NewTransaction(
+		[]solana.Instruction{
+			token.NewApproveCheckedInstruction(
+				record.Amount,
+				record.Decimals,
+				source,
+				mint,
+				r.keyPair.PublicKey(), // delegate
+				wallet,                // owner
+				[]solana.PublicKey{},
+			).Build(),
+		},
+		latest.Blockhash,
+		solana.TransactionPayer(wallet),
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to create approval transaction: %v", err)
+	}
+	// empty signatures the client's wallet fills in
+	tx.Signatures = make([]solana.Signature, tx.Message.Header.NumRequiredSignatures)
+
+	message, err := tx.Message.MarshalBinary()
+	if err != nil {
+		return "", fmt.Errorf("failed to serialize approval message: %v", err)
+	}
+	txBytes, err := tx.MarshalBinary()
+	if err != nil {
+		return "", fmt.Errorf("failed to serialize approval transaction: %v", err)
+	}
+
+	record.Source = source.String()
+	record.ApprovalMessage = base64.StdEncoding.EncodeToString(message)
+	record.LastValidBlockHeight = latest.LastValidBlockHeight
+	return base64.StdEncoding.EncodeToString(txBytes), nil
+}
+
+// issuedTx rebuilds the transaction issued for record from its stored message,
+// for a client that reclaims the request before signing it
+func (r *Router) issuedTx(record *types.RequestRecord) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(record.ApprovalMessage)
+	if err != nil || len(data) == 0 {
+		return "", fmt.Errorf("no transaction was issued for request %s", record.RequestID)
+	}
+	var message solana.Message
+	if err := message.UnmarshalWithDecoder(bin.NewBinDecoder(data)); err != nil {
+		return "", fmt.Errorf("failed to decode issued message: %v", err)
+	}
+	tx := &solana.Transaction{
+		Message:    message,
+		Signatures: make([]solana.Signature, message.Header.NumRequiredSignatures),
+	}
+	if record.PaymentMode == paymentEscrow {
+		// the escrow transaction is handed out signed by the router
+		if _, err := tx.PartialSign(func(key solana.PublicKey) *solana.PrivateKey {
+			if key.Equals(r.keyPair.PublicKey()) {
+				return r.keyPair
+			}
+			return nil
+		}); err != nil {
+			return "", fmt.Errorf("failed to sign escrow transaction: %v", err)
+		}
+	}
+	txBytes, err := tx.MarshalBinary()
+	if err != nil {
+		return "", fmt.Errorf("failed to serialize issued transaction: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(txBytes), nil
+}
+
+// Codes of TxValidationError
+const (
+	TxInvalidEncoding       = "INVALID_ENCODING"
+	TxInvalidSignature      = "INVALID_SIGNATURE"
+	TxUnexpectedInstruction = "UNEXPECTED_INSTRUCTION"
+	TxApproveCount          = "APPROVE_COUNT"
+	TxWrongDelegate         = "WRONG_DELEGATE"
+	TxAmountTooLow          = "AMOUNT_TOO_LOW"
+	TxMintNotAccepted       = "MINT_NOT_ACCEPTED"
+	TxNotIssued             = "NOT_ISSUED"
+	TxWrongSigner           = "WRONG_SIGNER"
+)
+
+// TxValidationError is returned for a client transaction the router refuses to relay
+type TxValidationError struct {
+	Code   string `json:"code"`
+	Reason string `json:"reason"`
+}
+
+func (e *TxValidationError) Error() string {
+	return fmt.Sprintf("invalid transaction (%s): %s", e.Code, e.Reason)
+}
+
+func invalidTx(code, format string, args ...interface{}) error {
+	return &TxValidationError{Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+// validateApprovalTx checks a client signed transaction before it is relayed.
+// It must be fully signed and consist of exactly one SPL token approval, next
+// to optional compute budget instructions, that delegates at least the price
+// of record to the router on an account of the accepted mint of record.
+func (r *Router) validateApprovalTx(tx *solana.Transaction, record *types.RequestRecord) error {
+	if err := tx.VerifySignatures(); err != nil {
+		return invalidTx(TxInvalidSignature, "%v", err)
+	}
+
+	var approvals []*token.Instruction
+	for _, compiled := range tx.Message.Instructions {
+		programID, err := tx.Message.Program(compiled.ProgramIDIndex)
+		if err != nil {
+			return invalidTx(TxInvalidEncoding, "%v", err)
+		}
+		switch {
+		case programID.Equals(solana.ComputeBudget):
+			continue
+		case !programID.Equals(token.ProgramID):
+			return invalidTx(TxUnexpectedInstruction, "instruction of program %s", programID)
+		}
+		accounts, err := compiled.ResolveInstructionAccounts(&tx.Message)
+		if err != nil {
+			return invalidTx(TxInvalidEncoding, "%v", err)
+		}
+		inst, err := token.DecodeInstruction(accounts, compiled.Data)
+		if err != nil {
+			return invalidTx(TxInvalidEncoding, "%v", err)
+		}
+		switch inst.Impl.(type) {
+		case *token.Approve, *token.ApproveChecked:
+			approvals = append(approvals, inst)
+		default:
+			return invalidTx(TxUnexpectedInstruction, "token instruction %s", token.InstructionIDToName(inst.TypeID.Uint8()))
+		}
+	}
+	if len(approvals) != 1 {
+		return invalidTx(TxApproveCount, "expected exactly one approve instruction, found %d", len(approvals))
+	}
+
+	mint, err := solana.PublicKeyFromBase58(record.Mint)
+	if err != nil || !r.pricing.accepts(mint) {
+		return invalidTx(TxMintNotAccepted, "mint %s is not accepted", mint)
+	}
+
+	var amount uint64
+	var delegate solana.PublicKey
+	switch approve := approvals[0].Impl.(type) {
+	case *token.ApproveChecked:
+		amount, delegate = *approve.Amount, approve.GetDelegateAccount().PublicKey
+		if got := approve.GetMintAccount().PublicKey; !got.Equals(mint) {
+			return invalidTx(TxMintNotAccepted, "approval is for mint %s, not %s", got, mint)
+		}
+	case *token.Approve:
+		// a plain approve names no mint, so the source must be the owner's account of the mint
+		amount, delegate = *approve.Amount, approve.GetDelegateAccount().PublicKey
+		ata, _, err := solana.FindAssociatedTokenAddress(approve.GetOwnerAccount().PublicKey, mint)
+		if err != nil || !ata.Equals(approve.GetSourceAccount().PublicKey) {
+			return invalidTx(TxMintNotAccepted, "source %s is not a %s account of the owner", approve.GetSourceAccount().PublicKey, mint)
+		}
+	}
+	if !delegate.Equals(r.keyPair.PublicKey()) {
+		return invalidTx(TxWrongDelegate, "delegate %s is not the router", delegate)
+	}
+	if amount < record.Amount {
+		return invalidTx(TxAmountTooLow, "approved %d, price is %d", amount, record.Amount)
+	}
+	return nil
+}
+
+// checkSigner verifies that wallet is among the signers of tx, so a session
+// can only relay transactions of the wallet it authenticated with
+func checkSigner(tx *solana.Transaction, wallet string) error {
+	signer, err := solana.PublicKeyFromBase58(wallet)
+	if err != nil {
+		return invalidTx(TxWrongSigner, "invalid wallet %s", wallet)
+	}
+	if !tx.IsSigner(signer) {
+		return invalidTx(TxWrongSigner, "transaction is not signed by %s", signer)
+	}
+	return nil
+}
+
+// checkApprovalTx verifies that tx is the approval transaction issued for
+// record, byte for byte apart from its signatures
+func checkApprovalTx(tx *solana.Transaction, record *types.RequestRecord) error {
+	issued, err := base64.StdEncoding.DecodeString(record.ApprovalMessage)
+	if err != nil || len(issued) == 0 {
+		return invalidTx(TxNotIssued, "no approval transaction was issued for request %s", record.RequestID)
+	}
+	message, err := tx.Message.MarshalBinary()
+	if err != nil {
+		return invalidTx(TxInvalidEncoding, "%v", err)
+	}
+	if !bytes.Equal(message, issued) {
+		return invalidTx(TxNotIssued, "signed transaction differs from the issued approval transaction")
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package router
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/gagliardetto/solana-go"
+	computebudget "github.com/gagliardetto/solana-go/programs/compute-budget"
+	"github.com/gagliardetto/solana-go/programs/system"
+	"github.com/gagliardetto/solana-go/programs/token"
+	"github.com/router/types"
+)
+
+const testPrice = 250_000
+
+type approvalFixture struct {
+	router    *Router
+	wallet    solana.PrivateKey
+	source    solana.PublicKey
+	mint      solana.PublicKey
+	blockhash solana.Hash
+}
+
+func newApprovalFixture(t *testing.T) *approvalFixture {
+	t.Helper()
+	routerKey, err := solana.NewRandomPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet, err := solana.NewRandomPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mint := solana.MustPublicKeyFromBase58("EPjFWdd5AufqSSqeM2qN1xzybapC8G4wEGGkZwyTDt1v")
+	source, _, err := solana.FindAssociatedTokenAddress(wallet.PublicKey(), mint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &approvalFixture{
+		router: &Router{
+			keyPair: &routerKey,
+			pricing: &priceBook{tokens: []*acceptedToken{{Symbol: "USDC", Mint: mint, Price: "0.25", Decimals: 6, Amount: testPrice, resolved: true}}},
+		},
+		wallet:    wallet,
+		source:    source,
+		mint:      mint,
+		blockhash: solana.Hash{1, 2, 3},
+	}
+}
+
+// approve is the instruction the router issues, for amount to delegate
+func (f *approvalFixture) approve(amount uint64, mint, delegate solana.PublicKey) solana.Instruction {
+	return token.NewApproveCheckedInstruction(amount, 6, f.source, mint, delegate, f.wallet.PublicKey(), []solana.PublicKey{}).Build()
+}
+
+// signed builds a transaction of instructions paid and signed by the wallet
+func (f *approvalFixture) signed(t *testing.T, instructions ...solana.Instruction) *solana.Transaction {
+	t.Helper()
+	tx, err := solana.NewTransaction(instructions, f.blockhash, solana.TransactionPayer(f.wallet.PublicKey()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Sign(func(key solana.PublicKey) *solana.PrivateKey {
+		if key.Equals(f.wallet.PublicKey()) {
+			return &f.wallet
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+// record returns the request tx was issued for
+func (f *approvalFixture) record(t *testing.T, issued *solana.Transaction) *types.RequestRecord {
+	t.Helper()
+	message, err := issued.Message.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &types.RequestRecord{
+		RequestID:       "request",
+		Wallet:          f.wallet.PublicKey().String(),
+		Mint:            f.mint.String(),
+		Amount:          testPrice,
+		Decimals:        6,
+		ApprovalMessage: base64.StdEncoding.EncodeToString(message),
+	}
+}
+
+// validate runs the checks handleSignedTx makes, in the same order
+func (f *approvalFixture) validate(tx *solana.Transaction, record *types.RequestRecord) error {
+	err := f.router.validateApprovalTx(tx, record)
+	if err == nil {
+		err = checkSigner(tx, record.Wallet)
+	}
+	if err == nil {
+		err = checkApprovalTx(tx, record)
+	}
+	return err
+}
+
+func TestValidateApprovalTx(t *testing.T) {
+	f := newApprovalFixture(t)
+	delegate := f.router.keyPair.PublicKey()
+	other, err := solana.NewRandomPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherMint := solana.MustPublicKeyFromBase58("J1toso1uCk3RLmjorhTtrVwY9HJ7X8V9yYac6Y7kGCPn")
+
+	tests := []struct {
+		name string
+		// tx is the transaction the client sends, issued the one the router
+		// issued; nil for tx itself
+		tx     func() *solana.Transaction
+		issued func() *solana.Transaction
+		record func(*types.RequestRecord)
+		code   string // empty when the transaction is valid
+	}{
+		{
+			name: "issued approval",
+			tx:   func() *solana.Transaction { return f.signed(t, f.approve(testPrice, f.mint, delegate)) },
+		},
+		{
+			name: "compute budget allowed",
+			tx: func() *solana.Transaction {
+				return f.signed(t, computebudget.NewSetComputeUnitPriceInstruction(1000).Build(), f.approve(testPrice, f.mint, delegate))
+			},
+		},
+		{
+			name: "unsigned",
+			tx: func() *solana.Transaction {
+				tx := f.signed(t, f.approve(testPrice, f.mint, delegate))
+				tx.Signatures[0] = solana.Signature{}
+				return tx
+			},
+			code: TxInvalidSignature,
+		},
+		{
+			name: "signature of other bytes",
+			tx: func() *solana.Transaction {
+				tx := f.signed(t, f.approve(testPrice, f.mint, delegate))
+				tx.Message.RecentBlockhash = solana.Hash{9}
+				return tx
+			},
+			code: TxInvalidSignature,
+		},
+		{
+			name: "extra system instruction",
+			tx: func() *solana.Transaction {
+				return f.signed(t, f.approve(testPrice, f.mint, delegate),
+					system.NewTransferInstruction(1, f.wallet.PublicKey(), other.PublicKey()).Build())
+			},
+			code: TxUnexpectedInstruction,
+		},
+		{
+			name: "extra token instruction",
+			tx: func() *solana.Transaction {
+				return f.signed(t, f.approve(testPrice, f.mint, delegate),
+					token.NewTransferInstruction(1, f.source, other.PublicKey(), f.wallet.PublicKey(), []solana.PublicKey{}).Build())
+			},
+			code: TxUnexpectedInstruction,
+		},
+		{
+			name: "undecodable token instruction",
+			tx: func() *solana.Transaction {
+				return f.signed(t, f.approve(testPrice, f.mint, delegate),
+					solana.NewInstruction(token.ProgramID, solana.AccountMetaSlice{solana.Meta(f.source).WRITE()}, []byte{0xff}))
+			},
+			code: TxInvalidEncoding,
+		},
+		{
+			name: "two approvals",
+			tx: func() *solana.Transaction {
+				return f.signed(t, f.approve(testPrice, f.mint, delegate), f.approve(testPrice, f.mint, delegate))
+			},
+			code: TxApproveCount,
+		},
+		{
+			name: "no approval",
+			tx: func() *solana.Transaction {
+				return f.signed(t, computebudget.NewSetComputeUnitPriceInstruction(1000).Build())
+			},
+			code: TxApproveCount,
+		},
+		{
+			name: "other mint",
+			tx:   func() *solana.Transaction { return f.signed(t, f.approve(testPrice, otherMint, delegate)) },
+			code: TxMintNotAccepted,
+		},
+		{
+			name:   "request mint not accepted",
+			tx:     func() *solana.Transaction { return f.signed(t, f.approve(testPrice, otherMint, delegate)) },
+			record: func(record *types.RequestRecord) { record.Mint = otherMint.String() },
+			code:   TxMintNotAccepted,
+		},
+		{
+			name: "wrong delegate",
+			tx:   func() *solana.Transaction { return f.signed(t, f.approve(testPrice, f.mint, other.PublicKey())) },
+			code: TxWrongDelegate,
+		},
+		{
+			name: "amount too low",
+			tx:   func() *solana.Transaction { return f.signed(t, f.approve(testPrice-1, f.mint, delegate)) },
+			code: TxAmountTooLow,
+		},
+		{
+			name:   "signed by another wallet",
+			tx:     func() *solana.Transaction { return f.signed(t, f.approve(testPrice, f.mint, delegate)) },
+			record: func(record *types.RequestRecord) { record.Wallet = other.PublicKey().String() },
+			code:   TxWrongSigner,
+		},
+		{
+			name:   "changed message bytes",
+			tx:     func() *solana.Transaction { return f.signed(t, f.approve(testPrice+1, f.mint, delegate)) },
+			issued: func() *solana.Transaction { return f.signed(t, f.approve(testPrice, f.mint, delegate)) },
+			code:   TxNotIssued,
+		},
+		{
+			name:   "nothing issued",
+			tx:     func() *solana.Transaction { return f.signed(t, f.approve(testPrice, f.mint, delegate)) },
+			record: func(record *types.RequestRecord) { record.ApprovalMessage = "" },
+			code:   TxNotIssued,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := tt.tx()
+			issued := tx
+			if tt.issued != nil {
+				issued = tt.issued()
+			}
+			record := f.record(t, issued)
+			if tt.record != nil {
+				tt.record(record)
+			}
+
+			err := f.validate(tx, record)
+			if tt.code == "" {
+				if err != nil {
+					t.Fatalf("valid transaction rejected: %v", err)
+				}
+				return
+			}
+			var txErr *TxValidationError
+			if !errors.As(err, &txErr) {
+				t.Fatalf("got %v, want a %s TxValidationError", err, tt.code)
+			}
+			if txErr.Code != tt.code {
+				t.Errorf("got code %s (%s), want %s", txErr.Code, txErr.Reason, tt.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package router
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/gagliardetto/solana-go"
+	"github.com/router/network/ws"
+)
+
+const (
+	// how long a client has to sign a challenge
+	challengeTTL = 2 * time.Minute
+
+	// keys of the client context
+	ctxChallenge = "challenge"
+	ctxWallet    = "wallet"
+)
+
+type challenge struct {
+	message  string
+	issuedAt time.Time
+}
+
+// challengeMessage is what the client's wallet signs to authenticate, the
+// same text wallets show to the user when asked to sign it
+func challengeMessage(nonce string) string {
+	return "Sign in to the ip geo router\nnonce: " + nonce
+}
+
+// authenticatedWallet returns the wallet the client proved to own, if any
+func authenticatedWallet(client *ws.WSClient) (string, bool) {
+	wallet, ok := client.GetContext(ctxWallet).(string)
+	return wallet, ok && wallet != ""
+}
+
+// handleChallenge : ws api starting the wallet authentication of a session.
+// It sends a fresh nonce for the client's wallet to sign, replacing any
+// earlier challenge of the session.
+func (r *Router) handleChallenge(req *ws.Empty, client *ws.WSClient) (*Challenge, error) {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate challenge: %v", err)
+	}
+	message := challengeMessage(base64.RawURLEncoding.EncodeToString(nonce))
+	client.SetContext(ctxChallenge, &challenge{message: message, issuedAt: time.Now()})
+
+	return &Challenge{Message: message, ExpiresIn: int(challengeTTL / time.Second)}, nil
+}
+
+// handleChallengeResponse : ws api completing the wallet authentication of a
+// session. The client sends its wallet and the base58 ed25519 signature of the
+// challenge message; once verified the wallet is bound to the session.
+func (r *Router) handleChallengeResponse(req *AuthenticateRequest, client *ws.WSClient) (*Authenticated, error) {
+	wallet, signature := req.Wallet, req.Signature
+
+	// a challenge is only good for one attempt
+	issued, ok := client.GetContext(ctxChallenge).(*challenge)
+	client.ClearContext(ctxChallenge)
+	if !ok || time.Since(issued.issuedAt) > challengeTTL {
+		return nil, ws.Errorf(ws.CodeUnauthorized, "no pending challenge, request a new one")
+	}
+	signer, err := solana.PublicKeyFromBase58(wallet)
+	if err != nil {
+		return nil, ws.Errorf(ws.CodeInvalidPayload, "invalid wallet: %v", err)
+	}
+	sig, err := solana.SignatureFromBase58(signature)
+	if err != nil {
+		return nil, ws.Errorf(ws.CodeInvalidPayload, "invalid signature: %v", err)
+	}
+	if !sig.Verify(signer, []byte(issued.message)) {
+		return nil, ws.Errorf(ws.CodeUnauthorized, "challenge is not signed by wallet %s", wallet)
+	}
+
+	client.SetContext(ctxWallet, signer.String())
+	r.wsHub.BindWallet(client, signer.String())
+	r.log.Info("Websocket session authenticated", "wallet", signer)
+	return &Authenticated{Wallet: signer.String()}, nil
+}
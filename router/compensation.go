@@ -0,0 +1,258 @@
+package router
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gagliardetto/solana-go"
+	"github.com/gagliardetto/solana-go/programs/token"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/router/network/ws"
+	"github.com/router/types"
+)
+
+// paymentOnEnter is the payment state a request reaches when it enters a state
+var paymentOnEnter = map[types.RequestState]types.PaymentState{
+	types.StateApproved: types.PaymentAuthorized,
+	types.StatePaid:     types.PaymentCharged,
+	types.StateRefunded: types.PaymentRefunded,
+}
+
+// owesClient reports whether the client paid for record and has not received
+// its result or been compensated
+func owesClient(record *types.RequestRecord) bool {
+	if record.State == types.StateDelivered {
+		return false
+	}
+	return record.Payment == types.PaymentAuthorized || record.Payment == types.PaymentCharged
+}
+
+// compensate makes up for a request the client paid for but will not receive:
+//   - an escrow is paid back and closed,
+//   - an unused allowance cannot be revoked by the router, as only the owner of
+//     the token account may revoke its delegate, so the client is sent a revoke
+//     transaction to sign, over client if still connected,
+//   - a fee already paid out to the gpings is refunded from the router's own
+//     token account of the mint,
+//   - a debit of a credit balance is given back, whether or not it was paid out.
+//
+// Every step is recorded in the ledger. Only one compensation of a request
+// runs at a time, and a request is compensated at most once.
+func (r *Router) compensate(record *types.RequestRecord, reason string, client *ws.WSClient) error {
+	if _, busy := r.compensating.LoadOrStore(record.RequestID, struct{}{}); busy {
+		return fmt.Errorf("request %s is already being compensated", record.RequestID)
+	}
+	defer r.compensating.Delete(record.RequestID)
+	if record.PayoutAttempt != nil {
+		// a payout that may still land decides what is owed
+		if err := r.settlePayout(record); err != nil {
+			return err
+		}
+	}
+	if !owesClient(record) {
+		return nil
+	}
+
+	switch {
+	case record.PaymentMode == paymentCredits:
+		if err := r.credits.balances.Return(record.Wallet, record.Mint, record.Amount, record.RequestID); err != nil {
+			r.recordCompensation(record, types.CompensationCreditReturn, types.CompensationFailed, "", fmt.Sprintf("%s: %v", reason, err))
+			return fmt.Errorf("failed to return credit: %v", err)
+		}
+		r.recordCompensation(record, types.CompensationCreditReturn, types.CompensationConfirmed, "", reason)
+		return r.transition(record, types.StateRefunded)
+	case record.Payment == types.PaymentCharged:
+		instructions, writable, err := r.treasuryRefundInstructions(record)
+		if err != nil {
+			return err
+		}
+		return r.sendRefund(record, types.CompensationRefund, reason, instructions, writable)
+	case record.PaymentMode == paymentEscrow:
+		instructions, writable, err := r.escrowRefundInstructions(record)
+		if err != nil {
+			return err
+		}
+		return r.sendRefund(record, types.CompensationEscrowRefund, reason, instructions, writable)
+	default:
+		return r.requestRevoke(record, reason, client)
+	}
+}
+
+// settlePayout finds out whether a payout sent earlier landed, moving record
+// to Paid if so. A payout on a durable nonce that has not moved can still
+// land, it is carried on rather than raced by a refund.
+func (r *Router) settlePayout(record *types.RequestRecord) error {
+	ctx, cancel := context.WithTimeout(context.Background(), confirmTimeout)
+	defer cancel()
+	txHash, err := r.settleRouterTx(ctx, record.PayoutAttempt)
+	switch {
+	case errors.Is(err, errNonceOpen):
+		return r.payout(record)
+	case err == nil:
+		r.endAttempt(&record.PayoutAttempt)
+		record.PayoutTx = txHash
+		return r.transition(record, types.StatePaid)
+	case settled(err):
+		r.endAttempt(&record.PayoutAttempt)
+		return r.saveRequest(record)
+	default:
+		return fmt.Errorf("payout still pending: %w", err)
+	}
+}
+
+// sendRefund sends a refund paid and signed by the router, and moves record
+// to Refunded once it confirms. A refund sent earlier is settled first, and
+// while it may still land no other is sent.
+func (r *Router) sendRefund(record *types.RequestRecord, kind, reason string, instructions []solana.Instruction, writable []solana.PublicKey) error {
+	if record.RefundTx != "" {
+		// refunded already, only the state change was lost
+		return r.transition(record, types.StateRefunded)
+	}
+	r.log.Info("Refunding request", "request_id", record.RequestID, "kind", kind, "reason", reason)
+	// closing the escrow makes its refunds exclusive, refunds from the
+	// treasury are not
+	exclusive := kind == types.CompensationEscrowRefund
+	refundTxHash, err := r.sendRouterTx(record, &record.RefundAttempt, instructions, writable, exclusive)
+	if err != nil && record.RefundAttempt != nil {
+		// in progress rather than failed, the next pass settles it
+		r.log.Warn("Refund still pending", "request_id", record.RequestID, "kind", kind, "txs", record.RefundAttempt.Signatures, "error", err)
+		return fmt.Errorf("refund pending: %v", err)
+	}
+	if err != nil {
+		r.recordCompensation(record, kind, types.CompensationFailed, "", fmt.Sprintf("%s: %v", reason, err))
+		return fmt.Errorf("failed to refund: %v", err)
+	}
+	record.RefundTx = refundTxHash
+	r.recordCompensation(record, kind, types.CompensationConfirmed, refundTxHash, reason)
+	return r.transition(record, types.StateRefunded)
+}
+
+// treasuryRefundInstructions pay the price of record from the router's own
+// token account of the mint back to the client
+func (r *Router) treasuryRefundInstructions(record *types.RequestRecord) ([]solana.Instruction, []solana.PublicKey, error) {
+	wallet, err := solana.PublicKeyFromBase58(record.Wallet)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid wallet: %v", err)
+	}
+	mint, err := solana.PublicKeyFromBase58(record.Mint)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid mint: %v", err)
+	}
+	treasury, _, err := solana.FindAssociatedTokenAddress(r.keyPair.PublicKey(), mint)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get associated token address: %v", err)
+	}
+	destination, _, err := solana.FindAssociatedTokenAddress(wallet, mint)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get associated token address: %v", err)
+	}
+	return []solana.Instruction{
+		token.NewTransferCheckedInstruction(
+			record.Amount,
+			record.Decimals,
+			treasury,
+			mint,
+			destination,
+			r.keyPair.PublicKey(),
+			[]solana.PublicKey{},
+		).Build(),
+	}, []solana.PublicKey{treasury}, nil
+}
+
+// requestRevoke issues the client a transaction revoking the router's
+// allowance on its token account, paid by the client's wallet
+func (r *Router) requestRevoke(record *types.RequestRecord, reason string, client *ws.WSClient) error {
+	wallet, err := solana.PublicKeyFromBase58(record.Wallet)
+	if err != nil {
+		return fmt.Errorf("invalid wallet: %v", err)
+	}
+	source, err := solana.PublicKeyFromBase58(record.Source)
+	if err != nil {
+		return fmt.Errorf("invalid source account: %v", err)
+	}
+	latest, err := r.solanaClient.GetLatestBlockhash(context.Background())
+	if err != nil {
+		return err
+	}
+	tx, err := solana.NewTransaction(
+		[]solana.Instruction{
+			token.NewRevokeInstruction(source, wallet, []solana.PublicKey{}).Build(),
+		},
+		latest.Blockhash,
+		solana.TransactionPayer(wallet),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create revoke transaction: %v", err)
+	}
+	tx.Signatures = make([]solana.Signature, tx.Message.Header.NumRequiredSignatures)
+	txBytes, err := tx.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("failed to serialize revoke transaction: %v", err)
+	}
+	revokeTx := base64.StdEncoding.EncodeToString(txBytes)
+
+	record.Payment = types.PaymentRevokeRequested
+	if err := r.saveRequest(record); err != nil {
+		return err
+	}
+	r.recordCompensation(record, types.CompensationRevoke, types.CompensationRequested, revokeTx, reason)
+	if client == nil {
+		return nil
+	}
+	return r.sendToClient(client, &ws.Message{
+		Type:      "revokeTx",
+		RequestID: record.RequestID,
+		Payload: map[string]interface{}{
+			"transaction":             revokeTx, // base64, to be signed and sent by the client's wallet
+			"source":                  record.Source,
+			"delegate":                r.keyPair.PublicKey().String(),
+			"reason":                  reason,
+			"last_valid_block_height": latest.LastValidBlockHeight,
+		},
+	})
+}
+
+func (r *Router) recordCompensation(record *types.RequestRecord, kind, status, tx, reason string) {
+	entry := &types.LedgerEntry{
+		ID:        uuid.New().String(),
+		RequestID: record.RequestID,
+		Kind:      kind,
+		Status:    status,
+		Wallet:    record.Wallet,
+		Mint:      record.Mint,
+		Amount:    record.Amount,
+		Tx:        tx,
+		Reason:    reason,
+		CreatedAt: time.Now(),
+	}
+	if err := r.ledger.Append(entry); err != nil {
+		// the transaction is on chain either way, the log keeps a trace of it
+		r.log.Error("Failed to record compensation", "request_id", record.RequestID, "kind", kind, "status", status, "tx", tx, "error", err)
+		return
+	}
+	r.log.Info("Compensation recorded", "request_id", record.RequestID, "kind", kind, "status", status, "tx", tx)
+}
+
+// Compensations : admin api listing the compensation ledger, optionally of one request.
+func (r *Router) Compensations(c *gin.Context) {
+	entries, err := r.ledger.List()
+	if err != nil {
+		r.RespError(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if requestID := c.Query("request_id"); requestID != "" {
+		filtered := entries[:0]
+		for _, entry := range entries {
+			if entry.RequestID == requestID {
+				filtered = append(filtered, entry)
+			}
+		}
+		entries = filtered
+	}
+	r.RespOK(c, gin.H{"total": len(entries), "entries": entries})
+}
@@ -0,0 +1,176 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gagliardetto/solana-go"
+	"github.com/router/config"
+	"github.com/router/network/ws"
+	"github.com/router/store"
+	"github.com/router/types"
+)
+
+const defaultDepositPollInterval = 15 * time.Second
+
+type credits struct {
+	enabled      bool
+	pollInterval time.Duration
+	balances     store.CreditStore
+}
+
+func newCredits(cfg config.Credits, balances store.CreditStore) *credits {
+	c := &credits{
+		enabled:      cfg.Enabled,
+		pollInterval: defaultDepositPollInterval,
+		balances:     balances,
+	}
+	if cfg.PollSeconds > 0 {
+		c.pollInterval = time.Duration(cfg.PollSeconds) * time.Second
+	}
+	return c
+}
+
+// depositAddress is the router's token account of mint, which clients deposit credits to
+func (r *Router) depositAddress(mint solana.PublicKey) (solana.PublicKey, error) {
+	ata, _, err := solana.FindAssociatedTokenAddress(r.keyPair.PublicKey(), mint)
+	if err != nil {
+		return solana.PublicKey{}, fmt.Errorf("failed to get associated token address: %v", err)
+	}
+	return ata, nil
+}
+
+// watchDeposits credits every finalized transfer into a deposit address to the
+// wallet it came from
+func (r *Router) watchDeposits() {
+	ticker := time.NewTicker(r.credits.pollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// a scan writes the credit store, which stays open until it is done
+		if !r.begin() {
+			return
+		}
+		for _, t := range r.pricing.tokens {
+			if err := r.scanDeposits(t.Mint); err != nil {
+				r.log.Warn("Failed to scan deposits", "mint", t.Mint, "error", err)
+			}
+		}
+		r.end()
+	}
+}
+
+func (r *Router) scanDeposits(mint solana.PublicKey) error {
+	account, err := r.depositAddress(mint)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.credits.pollInterval)
+	defer cancel()
+	cursor, scanned := r.credits.balances.Cursor(account.String())
+	if !scanned {
+		// what the account received before credits were enabled was not
+		// deposited as credit, scanning starts from its newest transaction
+		head, err := r.solanaClient.NewestSignature(ctx, account)
+		if err != nil {
+			return err
+		}
+		r.log.Info("Deposit scanning starts", "account", account, "mint", mint, "after", head)
+		return r.credits.balances.SetCursor(account.String(), head)
+	}
+	transfers, cursor, err := r.solanaClient.IncomingTransfers(ctx, account, mint, cursor)
+	if err != nil {
+		return err
+	}
+
+	for _, transfer := range transfers {
+		if transfer.Sender.IsZero() {
+			r.log.Warn("Deposit without a single sender not credited", "tx", transfer.Signature, "mint", mint, "amount", transfer.Amount)
+			continue
+		}
+		credited, err := r.credits.balances.Deposit(&types.CreditDeposit{
+			Signature:  transfer.Signature,
+			Slot:       transfer.Slot,
+			Account:    account.String(),
+			Wallet:     transfer.Sender.String(),
+			Mint:       mint.String(),
+			Amount:     transfer.Amount,
+			CreditedAt: time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+		if credited {
+			r.log.Info("Credits deposited", "wallet", transfer.Sender, "mint", mint, "amount", transfer.Amount, "tx", transfer.Signature)
+			// the wallet's sessions learn of it without polling their balance
+			r.wsHub.SendToWallet(transfer.Sender.String(), &ws.Message{
+				Type: "deposit",
+				Payload: map[string]interface{}{
+					"mint":   mint.String(),
+					"amount": strconv.FormatUint(transfer.Amount, 10), // base units
+					"tx":     transfer.Signature,
+				},
+			})
+		}
+	}
+	return r.credits.balances.SetCursor(account.String(), cursor)
+}
+
+// serveFromCredits debits the price of record from the client's credits and
+// serves the request without asking the client to sign anything. The gpings
+// are paid from the router's deposit account, where the credits are held.
+func (r *Router) serveFromCredits(record *types.RequestRecord, client *ws.WSClient) error {
+	mint, err := solana.PublicKeyFromBase58(record.Mint)
+	if err != nil {
+		return fmt.Errorf("invalid mint: %v", err)
+	}
+	source, err := r.depositAddress(mint)
+	if err != nil {
+		return err
+	}
+	record.Source = source.String()
+
+	if err := r.credits.balances.Debit(record.Wallet, record.Mint, record.Amount, record.RequestID); err != nil {
+		r.transition(record, types.StateFailed)
+		return ws.Errorf(ws.CodePaymentFailed, "%w", err).ForRequest(record.RequestID)
+	}
+	record.Payment = types.PaymentAuthorized
+	if err := r.saveRequest(record); err != nil {
+		return err
+	}
+
+	if err := r.locatePaid(record); err != nil {
+		return ws.Errorf(ws.CodeTimeout, "request timed out waiting for GPing consensus, the credit is returned: %w", err).ForRequest(record.RequestID)
+	}
+	return r.deliver(record, client)
+}
+
+// handleCreditBalance : ws api returning the credit balances of the session's
+// wallet and where to deposit more
+func (r *Router) handleCreditBalance(req *ws.Empty, client *ws.WSClient) (*CreditBalance, error) {
+	wallet, ok := authenticatedWallet(client)
+	if !ok {
+		return nil, ws.Errorf(ws.CodeUnauthorized, "wallet not authenticated, sign a challenge first")
+	}
+
+	balances, err := r.credits.balances.Balances(wallet)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make([]CreditToken, 0, len(r.pricing.tokens))
+	for _, t := range r.pricing.tokens {
+		deposit, err := r.depositAddress(t.Mint)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, CreditToken{
+			Symbol:         t.Symbol,
+			Mint:           t.Mint.String(),
+			Balance:        strconv.FormatUint(balances[t.Mint.String()], 10),
+			DepositAddress: deposit.String(),
+		})
+	}
+	return &CreditBalance{Wallet: wallet, Enabled: r.credits.enabled, Tokens: tokens}, nil
+}
@@ -0,0 +1,214 @@
+package router
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gagliardetto/solana-go"
+	"github.com/gagliardetto/solana-go/programs/system"
+	"github.com/gagliardetto/solana-go/programs/token"
+	"github.com/router/network/ws"
+	"github.com/router/types"
+)
+
+// size of an SPL token account
+const tokenAccountSize = 165
+
+// escrowAddress derives the escrow token account of a request from the router
+// key and the request id, so it can be recomputed from the record alone. The
+// router key owns the tokens in it, so only the router can release or refund it.
+// It is derived with CreateWithSeed rather than as a program derived address,
+// which would need an on-chain program to sign for it.
+func (r *Router) escrowAddress(requestID string) (solana.PublicKey, string, error) {
+	// a uuid without dashes fits the 32 byte seed limit
+	seed := strings.ReplaceAll(requestID, "-", "")
+	escrow, err := solana.CreateWithSeed(r.keyPair.PublicKey(), seed, token.ProgramID)
+	if err != nil {
+		return solana.PublicKey{}, "", fmt.Errorf("failed to derive escrow of request %s: %v", requestID, err)
+	}
+	return escrow, seed, nil
+}
+
+// buildEscrowTx builds the transaction the client signs to pay the request's
+// price into its escrow. It creates and initializes the escrow and transfers
+// the price into it from the client's token account. The client's wallet pays
+// the fee and the escrow's rent, which is returned when the escrow is closed.
+// The router signs for the escrow's base key before handing it out.
+func (r *Router) buildEscrowTx(record *types.RequestRecord) (string, error) {
+	wallet, err := solana.PublicKeyFromBase58(record.Wallet)
+	if err != nil {
+		return "", fmt.Errorf("invalid wallet: %v", err)
+	}
+	mint, err := solana.PublicKeyFromBase58(record.Mint)
+	if err != nil {
+		return "", fmt.Errorf("invalid mint: %v", err)
+	}
+	source, _, err := solana.FindAssociatedTokenAddress(wallet, mint)
+	if err != nil {
+		return "", fmt.Errorf("failed to get associated token address: %v", err)
+	}
+	escrow, seed, err := r.escrowAddress(record.RequestID)
+	if err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	rent, err := r.solanaClient.GetRentExemption(ctx, tokenAccountSize)
+	if err != nil {
+		return "", err
+	}
+	latest, err := r.solanaClient.GetLatestBlockhash(ctx)
+	if err != nil {
+		return "", err
+	}
+	router := r.keyPair.PublicKey()
+	tx, err := solana.NewTransaction(
+		[]solana.Instruction{
+			system.NewCreateAccountWithSeedInstruction(router, seed, rent, tokenAccountSize, token.ProgramID, wallet, escrow, router).Build(),
+			token.NewInitializeAccount3Instruction(router, escrow, mint).Build(),
+			token.NewTransferCheckedInstruction(
+				record.Amount,
+				record.Decimals,
+				source,
+				mint,
+				escrow,
+				wallet, // owner
+				[]solana.PublicKey{},
+			).Build(),
+		},
+		latest.Blockhash,
+		solana.TransactionPayer(wallet),
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to create escrow transaction: %v", err)
+	}
+	_, err = tx.PartialSign(func(key solana.PublicKey) *solana.PrivateKey {
+		if key.Equals(router) {
+			return r.keyPair
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to sign escrow transaction: %v", err)
+	}
+
+	message, err := tx.Message.MarshalBinary()
+	if err != nil {
+		return "", fmt.Errorf("failed to serialize escrow message: %v", err)
+	}
+	txBytes, err := tx.MarshalBinary()
+	if err != nil {
+		return "", fmt.Errorf("failed to serialize escrow transaction: %v", err)
+	}
+
+	record.Source = escrow.String()
+	record.ApprovalMessage = base64.StdEncoding.EncodeToString(message)
+	record.LastValidBlockHeight = latest.LastValidBlockHeight
+	return base64.StdEncoding.EncodeToString(txBytes), nil
+}
+
+// requestEscrowPayment sends the client the escrow transaction of record to
+// sign. The gpings are only asked once the escrow is funded.
+func (r *Router) requestEscrowPayment(record *types.RequestRecord, client *ws.WSClient) error {
+	escrowTx, err := r.buildEscrowTx(record)
+	if err != nil {
+		return err
+	}
+	if err := r.transition(record, types.StateAwaitingApproval); err != nil {
+		return err
+	}
+	return r.sendToClient(client, &ws.Message{
+		Type:      "unsignedTx",
+		RequestID: record.RequestID,
+		Payload: map[string]interface{}{
+			"transaction":             escrowTx, // base64, partially signed by the router, to be signed by the client's wallet
+			"mint":                    record.Mint,
+			"amount":                  strconv.FormatUint(record.Amount, 10),
+			"decimals":                record.Decimals,
+			"escrow":                  record.Source,
+			"last_valid_block_height": record.LastValidBlockHeight,
+		},
+	})
+}
+
+// validateEscrowTx checks a client signed escrow transaction before it is
+// relayed. Its message is the router's own, see checkApprovalTx, so it only
+// has to carry valid signatures of the client and the router.
+func validateEscrowTx(tx *solana.Transaction) error {
+	if err := tx.VerifySignatures(); err != nil {
+		return invalidTx(TxInvalidSignature, "%v", err)
+	}
+	return nil
+}
+
+// locatePaid asks the gpings for the location of a request paid upfront, by
+// a funded escrow or from credits. The client is compensated if they do not agree.
+func (r *Router) locatePaid(record *types.RequestRecord) error {
+	if record.State == types.StateApproved || record.State == types.StateCreated {
+		if err := r.transition(record, types.StateBroadcast); err != nil {
+			return err
+		}
+	}
+	result, err := r.locate(record.RequestID, record.IP)
+	if err != nil {
+		if compErr := r.compensate(record, err.Error(), nil); compErr != nil {
+			r.log.Error("Failed to refund escrow", "request_id", record.RequestID, "error", compErr)
+		}
+		return err
+	}
+	record.Result = result
+	return r.transition(record, types.StateLocated)
+}
+
+func (r *Router) closeEscrowInstruction(record *types.RequestRecord) (solana.Instruction, error) {
+	escrow, _, err := r.escrowAddress(record.RequestID)
+	if err != nil {
+		return nil, err
+	}
+	wallet, err := solana.PublicKeyFromBase58(record.Wallet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wallet: %v", err)
+	}
+	// the rent goes back to the client, who paid it
+	return token.NewCloseAccountInstruction(escrow, wallet, r.keyPair.PublicKey(), []solana.PublicKey{}).Build(), nil
+}
+
+// escrowRefundInstructions pay the escrow of record back to the client's
+// token account and close it
+func (r *Router) escrowRefundInstructions(record *types.RequestRecord) ([]solana.Instruction, []solana.PublicKey, error) {
+	wallet, err := solana.PublicKeyFromBase58(record.Wallet)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid wallet: %v", err)
+	}
+	mint, err := solana.PublicKeyFromBase58(record.Mint)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid mint: %v", err)
+	}
+	escrow, _, err := r.escrowAddress(record.RequestID)
+	if err != nil {
+		return nil, nil, err
+	}
+	destination, _, err := solana.FindAssociatedTokenAddress(wallet, mint)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get associated token address: %v", err)
+	}
+	closeEscrow, err := r.closeEscrowInstruction(record)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []solana.Instruction{
+		token.NewTransferCheckedInstruction(
+			record.Amount,
+			record.Decimals,
+			escrow,
+			mint,
+			destination,
+			r.keyPair.PublicKey(),
+			[]solana.PublicKey{},
+		).Build(),
+		closeEscrow,
+	}, []solana.PublicKey{escrow}, nil
+}
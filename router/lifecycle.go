@@ -0,0 +1,270 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/router/config"
+	"github.com/router/types"
+)
+
+const defaultReapInterval = 30 * time.Second
+
+// requestTransitions lists the legal next states of every non-terminal state.
+// Delegate payments locate first and are approved afterwards:
+// Created, Broadcast, Located, AwaitingApproval, Approved, Paid, Delivered.
+// Escrow payments are approved first:
+// Created, AwaitingApproval, Approved, Broadcast, Located, Paid, Delivered,
+// or Refunded once the escrow is funded but the gpings did not agree.
+// Credit payments are debited on creation and follow the delegate states from
+// Broadcast to Located, then Paid and Delivered.
+// A paid request that cannot be delivered is Refunded as well.
+var requestTransitions = map[types.RequestState][]types.RequestState{
+	types.StateCreated:          {types.StateBroadcast, types.StateAwaitingApproval, types.StateRefunded},
+	types.StateBroadcast:        {types.StateLocated, types.StateRefunded},
+	types.StateLocated:          {types.StateAwaitingApproval, types.StatePaid, types.StateRefunded},
+	types.StateAwaitingApproval: {types.StateApproved},
+	types.StateApproved:         {types.StatePaid, types.StateBroadcast, types.StateRefunded},
+	types.StatePaid:             {types.StateDelivered, types.StateRefunded},
+}
+
+// defaultStateTTLs is how long a request may stay in a state. For terminal
+// states it is how long the request is kept before it is deleted.
+var defaultStateTTLs = map[types.RequestState]time.Duration{
+	types.StateCreated:          time.Minute,
+	types.StateBroadcast:        2 * time.Minute,
+	types.StateLocated:          2 * time.Minute,
+	types.StateAwaitingApproval: 10 * time.Minute,
+	types.StateApproved:         30 * time.Minute,
+	types.StatePaid:             time.Hour,
+	types.StateDelivered:        time.Hour,
+	types.StateRefunded:         time.Hour,
+	types.StateExpired:          time.Hour,
+	types.StateFailed:           time.Hour,
+}
+
+type lifecycle struct {
+	ttls         map[types.RequestState]time.Duration
+	reapInterval time.Duration
+}
+
+func newLifecycle(cfg config.Lifecycle) *lifecycle {
+	l := &lifecycle{
+		ttls:         make(map[types.RequestState]time.Duration),
+		reapInterval: defaultReapInterval,
+	}
+	for state, ttl := range defaultStateTTLs {
+		l.ttls[state] = ttl
+	}
+	for state, seconds := range cfg.TTLSeconds {
+		if _, ok := l.ttls[types.RequestState(state)]; ok && seconds > 0 {
+			l.ttls[types.RequestState(state)] = time.Duration(seconds) * time.Second
+		}
+	}
+	if cfg.ReapIntervalSeconds > 0 {
+		l.reapInterval = time.Duration(cfg.ReapIntervalSeconds) * time.Second
+	}
+	return l
+}
+
+// canTransition reports whether a request may move from one state to another.
+// Every non-terminal state may also fail or expire.
+func canTransition(from, to types.RequestState) bool {
+	if from.Terminal() {
+		return false
+	}
+	if to == types.StateFailed || to == types.StateExpired {
+		return true
+	}
+	for _, next := range requestTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// saveRequest persists changes to record that do not change its state
+func (r *Router) saveRequest(record *types.RequestRecord) error {
+	r.requestsLock.Lock()
+	defer r.requestsLock.Unlock()
+	return r.putRequest(record, record.State)
+}
+
+// transition moves record to state to, restarting the state's TTL. It fails
+// if the move is illegal or if the stored request has moved on in the meantime,
+// e.g. because the reaper expired it.
+func (r *Router) transition(record *types.RequestRecord, to types.RequestState) error {
+	r.requestsLock.Lock()
+	defer r.requestsLock.Unlock()
+
+	from, payment := record.State, record.Payment
+	if !canTransition(from, to) {
+		return fmt.Errorf("illegal request transition %s -> %s", from, to)
+	}
+	record.State = to
+	record.ExpiresAt = time.Now().Add(r.lifecycle.ttls[to])
+	if next, ok := paymentOnEnter[to]; ok {
+		record.Payment = next
+	}
+	if err := r.putRequest(record, from); err != nil {
+		record.State, record.Payment = from, payment
+		return err
+	}
+	r.log.Info("Request state changed", "request_id", record.RequestID, "from", from, "to", to)
+	if to.Terminal() {
+		r.releaseNonces(record)
+	}
+	return nil
+}
+
+// reassignRequest moves the stored request to session and returns it with the
+// session it had. Other goroutines may hold older copies of the request while
+// it moves; putRequest keeps the stored session when they save theirs.
+func (r *Router) reassignRequest(requestID, session string) (*types.RequestRecord, string, error) {
+	r.requestsLock.Lock()
+	defer r.requestsLock.Unlock()
+
+	record, err := r.requests.Get(requestID)
+	if err != nil {
+		return nil, "", err
+	}
+	previous := record.Session
+	record.Session = session
+	record.UpdatedAt = time.Now()
+	if err := r.requests.Put(record); err != nil {
+		r.log.Error("Failed to save request", "request_id", requestID, "error", err)
+		return nil, "", fmt.Errorf("failed to save request: %v", err)
+	}
+	return record, previous, nil
+}
+
+// putRequest stores record if the stored copy is still in state expected.
+// Callers must hold requestsLock.
+func (r *Router) putRequest(record *types.RequestRecord, expected types.RequestState) error {
+	if stored, err := r.requests.Get(record.RequestID); err == nil {
+		if stored.State != expected {
+			return fmt.Errorf("request %s is %s, not %s", record.RequestID, stored.State, expected)
+		}
+		// only reassignRequest moves a request, maybe since record was read
+		record.Session = stored.Session
+	}
+	record.UpdatedAt = time.Now()
+	if err := r.requests.Put(record); err != nil {
+		r.log.Error("Failed to save request", "request_id", record.RequestID, "error", err)
+		return fmt.Errorf("failed to save request: %v", err)
+	}
+	return nil
+}
+
+// reapRequests expires requests that stayed too long in a state and deletes
+// terminal requests once their retention is over. Requests the client paid
+// for are compensated first, retried on every pass until that succeeds, and
+// so are requests whose submitted payment turns out to have landed.
+func (r *Router) reapRequests() {
+	ticker := time.NewTicker(r.lifecycle.reapInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if r.stopping() {
+			return
+		}
+		records, err := r.requests.List()
+		if err != nil {
+			r.log.Error("Failed to list requests", "error", err)
+			continue
+		}
+		now := time.Now()
+		for _, record := range records {
+			if now.Before(record.ExpiresAt) {
+				continue
+			}
+			if record.State.Terminal() {
+				// a hold the terminal transition did not know of, e.g. of an
+				// earlier run, ends with the request
+				r.releaseNonces(record)
+				if err := r.requests.Delete(record.RequestID); err != nil {
+					r.log.Error("Failed to delete request", "request_id", record.RequestID, "error", err)
+				}
+				continue
+			}
+			if owesClient(record) {
+				go r.compensateExpired(record)
+				continue
+			}
+			if record.State == types.StateAwaitingApproval && record.ApprovalTx != "" {
+				go r.expireApproval(record)
+				continue
+			}
+			if err := r.transition(record, types.StateExpired); err != nil {
+				r.log.Warn("Failed to expire request", "request_id", record.RequestID, "error", err)
+			}
+		}
+	}
+}
+
+// compensateExpired compensates a paid request that timed out, then expires
+// it unless the compensation already ended it
+func (r *Router) compensateExpired(record *types.RequestRecord) {
+	if !r.begin() {
+		return
+	}
+	defer r.end()
+	if err := r.compensate(record, fmt.Sprintf("request expired in state %s", record.State), nil); err != nil {
+		r.log.Warn("Failed to compensate expired request", "request_id", record.RequestID, "error", err)
+		return
+	}
+	if !record.State.Terminal() {
+		if err := r.transition(record, types.StateExpired); err != nil {
+			r.log.Warn("Failed to expire request", "request_id", record.RequestID, "error", err)
+		}
+	}
+}
+
+// expireApproval settles a request that expired awaiting the confirmation
+// of the payment the client submitted. A payment that landed is compensated,
+// and the request expires only once the payment can no longer land; until
+// then it is looked at again on every pass.
+func (r *Router) expireApproval(record *types.RequestRecord) {
+	if !r.begin() {
+		return
+	}
+	defer r.end()
+	ctx, cancel := context.WithTimeout(context.Background(), r.lifecycle.reapInterval)
+	err := r.confirmApproval(ctx, record)
+	cancel()
+	switch {
+	case err == nil:
+		r.log.Info("Payment of expired request landed", "request_id", record.RequestID, "tx", record.ApprovalTx)
+		if err := r.transition(record, types.StateApproved); err != nil {
+			return
+		}
+		r.compensateExpired(record)
+	case approvalFailed(err):
+		if err := r.transition(record, types.StateExpired); err != nil {
+			r.log.Warn("Failed to expire request", "request_id", record.RequestID, "error", err)
+		}
+	default:
+		r.log.Debug("Payment of expired request still pending", "request_id", record.RequestID, "tx", record.ApprovalTx, "error", err)
+	}
+}
+
+// RequestStats : admin api returning the number of requests in each state.
+func (r *Router) RequestStats(c *gin.Context) {
+	records, err := r.requests.List()
+	if err != nil {
+		r.RespError(c, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	counts := make(map[types.RequestState]int, len(types.RequestStates))
+	for _, state := range types.RequestStates {
+		counts[state] = 0
+	}
+	for _, record := range records {
+		counts[record.State]++
+	}
+	r.RespOK(c, gin.H{"total": len(records), "states": counts})
+}
@@ -0,0 +1,137 @@
+package router
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/router/common/log"
+	"github.com/router/config"
+	"github.com/router/network/ws"
+)
+
+const (
+	defaultRequestsPerSecond = 5
+	defaultRequestBurst      = 10
+)
+
+// Routes of the ws api. The legacy numbers are the request types of protocol
+// version 1.
+var (
+	routeIpGeoInfo     = ws.Route{Type: "ipGeoInfo", Legacy: 1}
+	routeSignedTx      = ws.Route{Type: "signedTx", Legacy: 2}
+	routeCreditBalance = ws.Route{Type: "creditBalance", Legacy: 3, Reply: "balance"}
+	routeChallenge     = ws.Route{Type: "challenge", Legacy: 4}
+	routeAuthenticate  = ws.Route{Type: "authenticate", Legacy: 5, Reply: "authenticated"}
+	routeReclaim       = ws.Route{Type: "reclaim", Legacy: 6}
+)
+
+// newMux is the mux of the ip geo hub. Every request but those authenticating
+// the session needs an authenticated wallet, and sessions are rate limited.
+func newMux(cfg config.WebSocket, logger log.Logger) *ws.Mux {
+	perSecond, burst := float64(defaultRequestsPerSecond), defaultRequestBurst
+	if cfg.RequestsPerSecond > 0 {
+		perSecond = cfg.RequestsPerSecond
+	}
+	if cfg.RequestBurst > 0 {
+		burst = cfg.RequestBurst
+	}
+	mux := ws.NewMux()
+	mux.Use(
+		ws.Recovery(),
+		ws.Logging(logger),
+		ws.RateLimit(perSecond, burst),
+		ws.Auth(func(client *ws.WSClient) bool {
+			_, ok := authenticatedWallet(client)
+			return ok
+		}, routeChallenge.Type, routeAuthenticate.Type),
+	)
+	return mux
+}
+
+// IpGeoInfoRequest asks for the location of an ip, paid by the session's wallet
+type IpGeoInfoRequest struct {
+	IP      string `json:"ip"`
+	Wallet  string `json:"wallet,omitempty"`  // must be the authenticated wallet if set
+	Token   string `json:"token,omitempty"`   // symbol or mint to pay with, the default token if empty
+	Payment string `json:"payment,omitempty"` // "credits" to pay from the wallet's credits
+}
+
+func (req *IpGeoInfoRequest) Validate() error {
+	if net.ParseIP(req.IP) == nil {
+		return fmt.Errorf("invalid ip %q", req.IP)
+	}
+	if req.Payment != "" && req.Payment != paymentCredits {
+		return fmt.Errorf("unknown payment %q", req.Payment)
+	}
+	return nil
+}
+
+// SignedTxRequest relays the client signed approval or escrow transaction of a request
+type SignedTxRequest struct {
+	RequestID string `json:"request_id"`
+	SignedTx  string `json:"signed_tx"` // base64
+}
+
+func (req *SignedTxRequest) Validate() error {
+	if req.RequestID == "" {
+		return fmt.Errorf("missing request_id")
+	}
+	if req.SignedTx == "" {
+		return fmt.Errorf("missing signed_tx")
+	}
+	return nil
+}
+
+// AuthenticateRequest answers the session's challenge
+type AuthenticateRequest struct {
+	Wallet    string `json:"wallet"`
+	Signature string `json:"signature"` // base58 ed25519 signature of the challenge message
+}
+
+func (req *AuthenticateRequest) Validate() error {
+	if req.Wallet == "" {
+		return fmt.Errorf("missing wallet")
+	}
+	if req.Signature == "" {
+		return fmt.Errorf("missing signature")
+	}
+	return nil
+}
+
+// ReclaimRequest moves a request to the calling session
+type ReclaimRequest struct {
+	RequestID   string `json:"request_id"`
+	ResumeToken string `json:"resume_token"`
+}
+
+func (req *ReclaimRequest) Validate() error {
+	if req.RequestID == "" {
+		return fmt.Errorf("missing request_id")
+	}
+	if req.ResumeToken == "" {
+		return fmt.Errorf("missing resume_token")
+	}
+	return nil
+}
+
+type Challenge struct {
+	Message   string `json:"message"` // to be signed as is by the wallet
+	ExpiresIn int    `json:"expires_in"`
+}
+
+type Authenticated struct {
+	Wallet string `json:"wallet"`
+}
+
+type CreditBalance struct {
+	Wallet  string        `json:"wallet"`
+	Enabled bool          `json:"enabled"`
+	Tokens  []CreditToken `json:"tokens"`
+}
+
+type CreditToken struct {
+	Symbol         string `json:"symbol"`
+	Mint           string `json:"mint"`
+	Balance        string `json:"balance"` // base units
+	DepositAddress string `json:"deposit_address"`
+}
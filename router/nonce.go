@@ -0,0 +1,96 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/gagliardetto/solana-go"
+	solclient "github.com/router/network/solana"
+)
+
+// noncePool hands out the router's durable nonce accounts, one payout at a
+// time per account, so concurrent payouts do not advance each other's nonce.
+// An account stays held while a transaction signed with it may still land.
+type noncePool struct {
+	accounts chan solana.PublicKey // free ones
+
+	lock  sync.Mutex
+	known map[solana.PublicKey]bool
+	held  map[solana.PublicKey]bool
+}
+
+// newNoncePool checks that every configured account is a nonce account under
+// the authority of the router key. It returns nil when none is configured, in
+// which case payouts use a recent blockhash.
+func newNoncePool(addresses []string, authority solana.PublicKey, solanaClient *solclient.SolanaClient) (*noncePool, error) {
+	if len(addresses) == 0 {
+		return nil, nil
+	}
+	p := &noncePool{
+		accounts: make(chan solana.PublicKey, len(addresses)),
+		known:    make(map[solana.PublicKey]bool, len(addresses)),
+		held:     make(map[solana.PublicKey]bool, len(addresses)),
+	}
+	for _, address := range addresses {
+		account, err := solana.PublicKeyFromBase58(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid nonce account %s: %v", address, err)
+		}
+		nonce, err := solanaClient.GetNonce(context.Background(), account)
+		if err != nil {
+			return nil, err
+		}
+		if !nonce.AuthorizedPubkey.Equals(authority) {
+			return nil, fmt.Errorf("nonce account %s is authorized to %s, not the router", account, nonce.AuthorizedPubkey)
+		}
+		if p.known[account] {
+			continue
+		}
+		p.known[account] = true
+		p.accounts <- account
+	}
+	return p, nil
+}
+
+// acquire waits for a free nonce account until ctx is done
+func (p *noncePool) acquire(ctx context.Context) (solana.PublicKey, error) {
+	select {
+	case account := <-p.accounts:
+		p.lock.Lock()
+		p.held[account] = true
+		p.lock.Unlock()
+		return account, nil
+	case <-ctx.Done():
+		return solana.PublicKey{}, fmt.Errorf("no free nonce account: %v", ctx.Err())
+	}
+}
+
+// release frees a held account. Releasing an account that is not held, or
+// not in the pool, does nothing.
+func (p *noncePool) release(account solana.PublicKey) {
+	p.lock.Lock()
+	if !p.held[account] {
+		p.lock.Unlock()
+		return
+	}
+	delete(p.held, account)
+	p.lock.Unlock()
+	p.accounts <- account
+}
+
+// hold takes account out of the pool for a transaction of an earlier run that
+// may still advance it. It must be called before any acquire.
+func (p *noncePool) hold(account solana.PublicKey) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.known[account] || p.held[account] {
+		return
+	}
+	p.held[account] = true
+	for i, n := 0, len(p.accounts); i < n; i++ {
+		if free := <-p.accounts; !free.Equals(account) {
+			p.accounts <- free
+		}
+	}
+}
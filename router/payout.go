@@ -0,0 +1,357 @@
+package router
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/gagliardetto/solana-go"
+	"github.com/gagliardetto/solana-go/programs/system"
+	"github.com/gagliardetto/solana-go/programs/token"
+	"github.com/gagliardetto/solana-go/rpc"
+	"github.com/router/config"
+	solclient "github.com/router/network/solana"
+	"github.com/router/types"
+)
+
+const (
+	defaultMaxPayees = 10
+
+	// how long the versions of a transaction on a durable nonce that moved
+	// are looked for
+	nonceSettleWait = 15 * time.Second
+)
+
+var (
+	errNonceOpen     = errors.New("durable nonce not advanced yet")
+	errNonceAdvanced = errors.New("durable nonce advanced by another transaction")
+	errNothingSent   = errors.New("no transaction sent")
+)
+
+// payoutShare is the part of the fee paid to one gping vault
+type payoutShare struct {
+	Vault  string `json:"vault"`
+	Amount uint64 `json:"amount"`
+}
+
+func newRewardConfig(cfg config.Reward) config.Reward {
+	switch cfg.Weighting {
+	case "accuracy", "latency", "equal":
+	default:
+		cfg.Weighting = "accuracy"
+	}
+	if cfg.MaxPayees <= 0 {
+		cfg.MaxPayees = defaultMaxPayees
+	}
+	return cfg
+}
+
+func rewardWeight(weighting string, v types.GpingVote) float64 {
+	switch weighting {
+	case "latency":
+		return 1 / (1 + v.Latency.Seconds())
+	case "equal":
+		return 1
+	default:
+		return 1 / (1 + v.DistanceKm)
+	}
+}
+
+// splitReward divides total between the agreeing gpings. votes are ordered
+// closest first, so rounding dust goes to the most accurate gping.
+func splitReward(cfg config.Reward, total uint64, votes []types.GpingVote) []payoutShare {
+	if len(votes) > cfg.MaxPayees {
+		votes = votes[:cfg.MaxPayees]
+	}
+
+	weights := make([]float64, len(votes))
+	var sum float64
+	for i, v := range votes {
+		weights[i] = rewardWeight(cfg.Weighting, v)
+		sum += weights[i]
+	}
+
+	shares := make([]payoutShare, 0, len(votes))
+	var paid uint64
+	for i, v := range votes {
+		amount := uint64(math.Floor(float64(total) * weights[i] / sum))
+		shares = append(shares, payoutShare{Vault: v.Vault, Amount: amount})
+		paid += amount
+	}
+	if len(shares) > 0 {
+		shares[0].Amount += total - paid
+	}
+
+	// drop vaults whose share rounded down to nothing
+	nonZero := shares[:0]
+	for _, s := range shares {
+		if s.Amount > 0 {
+			nonZero = append(nonZero, s)
+		}
+	}
+	return nonZero
+}
+
+// payoutInstructions builds one TransferChecked per share, moving the fee
+// from source into each vault's associated token account with the router as authority
+func (r *Router) payoutInstructions(shares []payoutShare, source, mint solana.PublicKey, decimals uint8) ([]solana.Instruction, error) {
+	instructions := make([]solana.Instruction, 0, len(shares))
+	for _, s := range shares {
+		vault, err := solana.PublicKeyFromBase58(s.Vault)
+		if err != nil {
+			return nil, fmt.Errorf("invalid vault address %s: %v", s.Vault, err)
+		}
+		vaultAta, _, err := solana.FindAssociatedTokenAddress(vault, mint)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get associated token address: %v", err)
+		}
+		instructions = append(instructions, token.NewTransferCheckedInstruction(
+			s.Amount,
+			decimals,
+			source,
+			mint,
+			vaultAta,
+			r.keyPair.PublicKey(),
+			[]solana.PublicKey{},
+		).Build())
+	}
+	return instructions, nil
+}
+
+// payout transfers the fee of a request whose payment is confirmed to its
+// gping vaults, and records the payout transaction and final status in the
+// store. An escrow is closed in the same transaction, returning its rent to
+// the client.
+func (r *Router) payout(record *types.RequestRecord) error {
+	if record.PayoutTx != "" {
+		// paid already, only the state change was lost
+		return r.transition(record, types.StatePaid)
+	}
+	source, err := solana.PublicKeyFromBase58(record.Source)
+	if err != nil {
+		return fmt.Errorf("invalid source account: %v", err)
+	}
+	mint, err := solana.PublicKeyFromBase58(record.Mint)
+	if err != nil {
+		return fmt.Errorf("invalid mint: %v", err)
+	}
+	shares := splitReward(r.reward, record.Amount, record.Result.Votes)
+	instructions, err := r.payoutInstructions(shares, source, mint, record.Decimals)
+	if err != nil {
+		return fmt.Errorf("failed to build payout instructions: %v", err)
+	}
+	if record.PaymentMode == paymentEscrow {
+		closeEscrow, err := r.closeEscrowInstruction(record)
+		if err != nil {
+			return err
+		}
+		instructions = append(instructions, closeEscrow)
+	}
+
+	// Every version of a payout spends the whole allowance or closes the
+	// escrow, so at most one of them can land. A credit payout moves the
+	// router's own tokens, nothing stops two versions of it from landing.
+	r.log.Info("Sending payout", "request_id", record.RequestID, "shares", shares)
+	exclusive := record.PaymentMode != paymentCredits
+	transferTxHash, err := r.sendRouterTx(record, &record.PayoutAttempt, instructions, []solana.PublicKey{source}, exclusive)
+	if err != nil {
+		return fmt.Errorf("failed to submit transfer: %w", err)
+	}
+	record.PayoutTx = transferTxHash
+	return r.transition(record, types.StatePaid)
+}
+
+// sendRouterTx sends a transaction of instructions paid and signed by the
+// router and waits for it to confirm. Every version sent is recorded in
+// attempt, a field of record, before it is sent; an attempt left by an earlier
+// call is settled first, and a new transaction is only signed once none of its
+// versions landed or can land anymore. An attempt on a durable nonce that has
+// not moved is carried on instead, on the same nonce. The priority fee is only
+// raised on rebroadcasts if the versions are exclusive, or use a durable
+// nonce, as every version is signed anew; otherwise the same transaction is
+// rebroadcast. On success the attempt is cleared, for the caller to persist
+// with the transaction's signature.
+func (r *Router) sendRouterTx(record *types.RequestRecord, attempt **types.RouterTx, instructions []solana.Instruction, writable []solana.PublicKey, exclusive bool) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), confirmTimeout)
+	defer cancel()
+
+	var open *types.RouterTx
+	if pending := *attempt; pending != nil {
+		txHash, err := r.settleRouterTx(ctx, pending)
+		switch {
+		case err == nil:
+			r.endAttempt(attempt)
+			return txHash, nil
+		case errors.Is(err, errNonceOpen):
+			open = pending
+		case !settled(err):
+			return "", fmt.Errorf("earlier transaction still pending: %w", err)
+		default:
+			r.log.Info("Earlier transaction did not land", "request_id", record.RequestID, "error", err)
+			r.endAttempt(attempt)
+		}
+	}
+
+	// With a durable nonce the transaction does not expire and every
+	// rebroadcast advances the same nonce
+	pending := open
+	var blockhash solana.Hash
+	var advance []solana.Instruction
+	var earlier []solana.Signature
+	if open != nil {
+		nonceAccount, err := solana.PublicKeyFromBase58(open.NonceAccount)
+		if err != nil {
+			return "", fmt.Errorf("invalid nonce account: %v", err)
+		}
+		if blockhash, err = solana.HashFromBase58(open.Nonce); err != nil {
+			return "", fmt.Errorf("invalid nonce: %v", err)
+		}
+		for _, txHash := range open.Signatures {
+			if sig, err := solana.SignatureFromBase58(txHash); err == nil {
+				earlier = append(earlier, sig)
+			}
+		}
+		advance = []solana.Instruction{
+			system.NewAdvanceNonceAccountInstruction(nonceAccount, solana.SysVarRecentBlockHashesPubkey, r.keyPair.PublicKey()).Build(),
+		}
+		// the latest version goes out again as signed before any other
+		if tx, err := solclient.DecodeTransaction(open.Signed); err == nil {
+			if _, err := r.solanaClient.SendTransaction(ctx, tx); err != nil {
+				r.log.Warn("Failed to resubmit transaction", "request_id", record.RequestID, "error", err)
+			}
+		}
+	} else if r.nonces != nil {
+		nonceAccount, err := r.nonces.acquire(ctx)
+		if err != nil {
+			return "", err
+		}
+		nonce, err := r.solanaClient.GetNonce(ctx, nonceAccount)
+		if err != nil {
+			r.nonces.release(nonceAccount)
+			return "", err
+		}
+		blockhash = solana.Hash(nonce.Nonce)
+		pending = &types.RouterTx{NonceAccount: nonceAccount.String(), Nonce: blockhash.String()}
+		// AdvanceNonceAccount must be the first instruction
+		advance = []solana.Instruction{
+			system.NewAdvanceNonceAccountInstruction(nonceAccount, solana.SysVarRecentBlockHashesPubkey, r.keyPair.PublicKey()).Build(),
+		}
+	} else {
+		latest, err := r.solanaClient.GetLatestBlockhash(ctx)
+		if err != nil {
+			return "", err
+		}
+		blockhash = latest.Blockhash
+		pending = &types.RouterTx{LastValidBlockHeight: latest.LastValidBlockHeight}
+	}
+
+	build := func(microLamports uint64) (*solana.Transaction, error) {
+		all := append([]solana.Instruction{}, advance...)
+		all = append(all, r.solanaClient.ComputeBudget(len(advance)+len(instructions), microLamports)...)
+		all = append(all, instructions...)
+		tx, err := solana.NewTransaction(
+			all,
+			blockhash,
+			solana.TransactionPayer(r.keyPair.PublicKey()),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create transaction: %v", err)
+		}
+		_, err = tx.Sign(func(key solana.PublicKey) *solana.PrivateKey {
+			if key.Equals(r.keyPair.PublicKey()) {
+				return r.keyPair
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to sign transaction: %v", err)
+		}
+		return tx, nil
+	}
+	*attempt = pending
+	sent := func(tx *solana.Transaction) error {
+		signed, err := tx.MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("failed to serialize transaction: %v", err)
+		}
+		pending.Signatures = append(pending.Signatures, tx.Signatures[0].String())
+		pending.Signed = base64.StdEncoding.EncodeToString(signed)
+		return r.saveRequest(record)
+	}
+	escalate := exclusive || advance != nil
+	txHash, err := r.solanaClient.SendWithPriorityFee(ctx, writable, pending.LastValidBlockHeight, earlier, escalate, build, sent)
+	if err == nil || len(pending.Signatures) == 0 {
+		r.endAttempt(attempt)
+	} else if settled(err) {
+		r.endAttempt(attempt)
+		r.saveRequest(record)
+	}
+	// otherwise a version may still land, and its nonce account stays held
+	return txHash, err
+}
+
+// settleRouterTx finds out what became of the versions of pending without
+// sending any. It returns the signature of the version that landed, or an
+// error settled reports true for once none did and none can anymore. A
+// version on a durable nonce that has not moved may still land, errNonceOpen
+// is returned for it.
+func (r *Router) settleRouterTx(ctx context.Context, pending *types.RouterTx) (string, error) {
+	if len(pending.Signatures) == 0 {
+		return "", errNothingSent
+	}
+	if pending.NonceAccount == "" {
+		// a version may land until its blockhash expires
+		return r.solanaClient.ConfirmAny(ctx, pending.Signatures, rpc.CommitmentConfirmed, pending.LastValidBlockHeight)
+	}
+
+	account, err := solana.PublicKeyFromBase58(pending.NonceAccount)
+	if err != nil {
+		return "", fmt.Errorf("invalid nonce account: %v", err)
+	}
+	nonce, err := r.solanaClient.GetNonce(ctx, account)
+	if err != nil {
+		return "", err
+	}
+	if solana.Hash(nonce.Nonce).String() == pending.Nonce {
+		return "", errNonceOpen
+	}
+	// the nonce moved, by one of the versions unless it was advanced some
+	// other way; a lagging rpc node is given a moment to show it
+	waitCtx, cancel := context.WithTimeout(ctx, nonceSettleWait)
+	defer cancel()
+	txHash, err := r.solanaClient.ConfirmAny(waitCtx, pending.Signatures, rpc.CommitmentConfirmed, 0)
+	if err != nil && waitCtx.Err() != nil && ctx.Err() == nil {
+		return "", errNonceAdvanced
+	}
+	return txHash, err
+}
+
+// endAttempt forgets the versions of a settled attempt and frees the nonce
+// account they held
+func (r *Router) endAttempt(attempt **types.RouterTx) {
+	if pending := *attempt; pending != nil && pending.NonceAccount != "" && r.nonces != nil {
+		if account, err := solana.PublicKeyFromBase58(pending.NonceAccount); err == nil {
+			r.nonces.release(account)
+		}
+	}
+	*attempt = nil
+}
+
+// releaseNonces frees the nonce accounts held for the transactions of record
+// that never settled, once record ended or is deleted and nothing settles them
+func (r *Router) releaseNonces(record *types.RequestRecord) {
+	for _, attempt := range []*types.RouterTx{record.PayoutAttempt, record.RefundAttempt} {
+		r.endAttempt(&attempt)
+	}
+}
+
+// settled reports whether err means none of the versions of a transaction
+// landed successfully, or can anymore
+func settled(err error) bool {
+	var txErr *solclient.TransactionError
+	return errors.As(err, &txErr) || errors.Is(err, solclient.ErrBlockhashExpired) ||
+		errors.Is(err, errNonceAdvanced) || errors.Is(err, errNothingSent)
+}
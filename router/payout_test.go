@@ -0,0 +1,75 @@
+package router
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/router/config"
+	"github.com/router/types"
+)
+
+func votes(distancesKm ...float64) []types.GpingVote {
+	out := make([]types.GpingVote, len(distancesKm))
+	for i, d := range distancesKm {
+		out[i] = types.GpingVote{
+			Vault:      fmt.Sprintf("vault-%d", i),
+			DistanceKm: d,
+			Latency:    time.Duration(i+1) * 100 * time.Millisecond,
+		}
+	}
+	return out
+}
+
+func TestSplitReward(t *testing.T) {
+	tests := []struct {
+		name      string
+		weighting string
+		maxPayees int
+		total     uint64
+		votes     []types.GpingVote
+		want      []uint64 // amounts, in the order of the shares
+	}{
+		{name: "equal even", weighting: "equal", total: 300, votes: votes(0, 1, 2), want: []uint64{100, 100, 100}},
+		{name: "equal remainder to closest", weighting: "equal", total: 100, votes: votes(0, 1, 2), want: []uint64{34, 33, 33}},
+		{name: "single gping", weighting: "accuracy", total: 7, votes: votes(3), want: []uint64{7}},
+		{name: "accuracy uneven", weighting: "accuracy", total: 1_000_001, votes: votes(0, 1, 3)},
+		{name: "latency uneven", weighting: "latency", total: 999_999_999, votes: votes(0, 0, 0, 0, 0, 0, 0)},
+		{name: "shares rounded to nothing dropped", weighting: "equal", total: 2, votes: votes(0, 1, 2), want: []uint64{2}},
+		{name: "max payees", weighting: "equal", maxPayees: 2, total: 11, votes: votes(0, 1, 2), want: []uint64{6, 5}},
+		{name: "large total", weighting: "accuracy", total: 1<<63 - 1, votes: votes(0, 0.5, 7, 40)},
+		{name: "zero total", weighting: "equal", total: 0, votes: votes(0, 1), want: []uint64{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newRewardConfig(config.Reward{Weighting: tt.weighting, MaxPayees: tt.maxPayees})
+			shares := splitReward(cfg, tt.total, tt.votes)
+
+			var sum uint64
+			for i, s := range shares {
+				if s.Amount == 0 {
+					t.Errorf("share %d of %s is zero", i, s.Vault)
+				}
+				if i > 0 && s.Amount > shares[0].Amount && tt.weighting != "latency" {
+					t.Errorf("share %d is larger than the closest gping's", i)
+				}
+				sum += s.Amount
+			}
+			if sum != tt.total {
+				t.Errorf("shares add up to %d, want %d", sum, tt.total)
+			}
+			if tt.want == nil {
+				return
+			}
+			if len(shares) != len(tt.want) {
+				t.Fatalf("got %d shares, want %d", len(shares), len(tt.want))
+			}
+			for i, want := range tt.want {
+				if shares[i].Amount != want {
+					t.Errorf("share %d is %d, want %d", i, shares[i].Amount, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/gagliardetto/solana-go"
+	"github.com/router/config"
+	solclient "github.com/router/network/solana"
+)
+
+// used when no token is configured, matching what the router charged before pricing was configurable
+var defaultTokens = []config.Token{
+	{Symbol: "JitoSOL", Mint: "9JUomKyopNpak1kZvBA6taUfV9rJxctLeFB8ac2iFDaH", Price: "1"},
+}
+
+// acceptedToken is a token a query can be paid with. Decimals and Amount are
+// filled from the mint account the first time the token is used.
+type acceptedToken struct {
+	Symbol   string
+	Mint     solana.PublicKey
+	Price    string
+	Decimals uint8
+	Amount   uint64 // Price in base units
+	resolved bool
+}
+
+// Payment modes, see config.Pricing. A client with a credit balance may pay
+// a request with credits instead, see config.Credits.
+const (
+	paymentDelegate = "delegate"
+	paymentEscrow   = "escrow"
+	paymentCredits  = "credits"
+)
+
+type priceBook struct {
+	lock         sync.Mutex
+	tokens       []*acceptedToken
+	defaultToken string
+	paymentMode  string
+	solanaClient *solclient.SolanaClient
+}
+
+func newPriceBook(cfg config.Pricing, solanaClient *solclient.SolanaClient) (*priceBook, error) {
+	tokens := cfg.Tokens
+	if len(tokens) == 0 {
+		tokens = defaultTokens
+	}
+	p := &priceBook{defaultToken: cfg.DefaultToken, paymentMode: cfg.PaymentMode, solanaClient: solanaClient}
+	switch p.paymentMode {
+	case "":
+		p.paymentMode = paymentDelegate
+	case paymentDelegate, paymentEscrow:
+	default:
+		return nil, fmt.Errorf("unknown payment mode %q", cfg.PaymentMode)
+	}
+	for _, t := range tokens {
+		mint, err := solana.PublicKeyFromBase58(t.Mint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mint of token %s: %v", t.Symbol, err)
+		}
+		if _, ok := new(big.Rat).SetString(t.Price); !ok {
+			return nil, fmt.Errorf("invalid price of token %s: %q", t.Symbol, t.Price)
+		}
+		p.tokens = append(p.tokens, &acceptedToken{Symbol: t.Symbol, Mint: mint, Price: t.Price})
+	}
+	if p.defaultToken == "" {
+		p.defaultToken = p.tokens[0].Mint.String()
+	}
+	return p, nil
+}
+
+// resolve returns the accepted token matching choice by symbol or mint, or the
+// default token when choice is empty
+func (p *priceBook) resolve(choice string) (*acceptedToken, error) {
+	if choice == "" {
+		choice = p.defaultToken
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, t := range p.tokens {
+		if t.Symbol != choice && t.Mint.String() != choice {
+			continue
+		}
+		if !t.resolved {
+			decimals, err := p.solanaClient.GetMintDecimals(context.Background(), t.Mint)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read mint %s: %v", t.Mint, err)
+			}
+			amount, err := toBaseUnits(t.Price, decimals)
+			if err != nil {
+				return nil, fmt.Errorf("invalid price of token %s: %v", t.Symbol, err)
+			}
+			t.Decimals, t.Amount, t.resolved = decimals, amount, true
+		}
+		resolved := *t
+		return &resolved, nil
+	}
+	return nil, fmt.Errorf("token %s is not accepted", choice)
+}
+
+// accepts reports whether queries can be paid with mint
+func (p *priceBook) accepts(mint solana.PublicKey) bool {
+	for _, t := range p.tokens {
+		if t.Mint.Equals(mint) {
+			return true
+		}
+	}
+	return false
+}
+
+// toBaseUnits converts a decimal price in whole tokens to base units
+func toBaseUnits(price string, decimals uint8) (uint64, error) {
+	r, ok := new(big.Rat).SetString(price)
+	if !ok {
+		return 0, fmt.Errorf("invalid price %q", price)
+	}
+	r.Mul(r, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil)))
+	if !r.IsInt() {
+		return 0, fmt.Errorf("price %s has more than %d decimals", price, decimals)
+	}
+	amount := r.Num()
+	if amount.Sign() <= 0 || !amount.IsUint64() {
+		return 0, fmt.Errorf("price %s out of range", price)
+	}
+	return amount.Uint64(), nil
+}
@@ -0,0 +1,99 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/gagliardetto/solana-go"
+)
+
+func TestToBaseUnits(t *testing.T) {
+	tests := []struct {
+		price    string
+		decimals uint8
+		want     uint64
+		err      bool
+	}{
+		{price: "1", decimals: 6, want: 1_000_000},
+		{price: "0.25", decimals: 6, want: 250_000},
+		{price: "0.000001", decimals: 6, want: 1},
+		{price: "1/4", decimals: 2, want: 25},
+		{price: "3", decimals: 0, want: 3},
+		{price: "18446744073709551615", decimals: 0, want: 1<<64 - 1},
+		{price: "0.0000001", decimals: 6, err: true}, // more fractional digits than the mint has
+		{price: "0.125", decimals: 2, err: true},
+		{price: "1/3", decimals: 9, err: true},
+		{price: "18446744073709551616", decimals: 0, err: true}, // overflows uint64
+		{price: "18446744073709.551616", decimals: 6, err: true},
+		{price: "0", decimals: 6, err: true},
+		{price: "0.0", decimals: 6, err: true},
+		{price: "-1", decimals: 6, err: true},
+		{price: "-0.5", decimals: 6, err: true},
+		{price: "", decimals: 6, err: true},
+		{price: "one", decimals: 6, err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := toBaseUnits(tt.price, tt.decimals)
+		if tt.err {
+			if err == nil {
+				t.Errorf("toBaseUnits(%q, %d) = %d, want an error", tt.price, tt.decimals, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("toBaseUnits(%q, %d) failed: %v", tt.price, tt.decimals, err)
+		} else if got != tt.want {
+			t.Errorf("toBaseUnits(%q, %d) = %d, want %d", tt.price, tt.decimals, got, tt.want)
+		}
+	}
+}
+
+func TestPriceBookResolve(t *testing.T) {
+	usdc := solana.MustPublicKeyFromBase58("EPjFWdd5AufqSSqeM2qN1xzybapC8G4wEGGkZwyTDt1v")
+	jitoSOL := solana.MustPublicKeyFromBase58("J1toso1uCk3RLmjorhTtrVwY9HJ7X8V9yYac6Y7kGCPn")
+	// resolved tokens, so that no mint has to be read
+	book := &priceBook{
+		defaultToken: usdc.String(),
+		tokens: []*acceptedToken{
+			{Symbol: "USDC", Mint: usdc, Price: "0.25", Decimals: 6, Amount: 250_000, resolved: true},
+			{Symbol: "JitoSOL", Mint: jitoSOL, Price: "0.001", Decimals: 9, Amount: 1_000_000, resolved: true},
+		},
+	}
+
+	tests := []struct {
+		choice string
+		want   solana.PublicKey
+		err    bool
+	}{
+		{choice: "", want: usdc},
+		{choice: "USDC", want: usdc},
+		{choice: "JitoSOL", want: jitoSOL},
+		{choice: jitoSOL.String(), want: jitoSOL},
+		{choice: "usdc", err: true},
+		{choice: "So11111111111111111111111111111111111111112", err: true},
+	}
+	for _, tt := range tests {
+		got, err := book.resolve(tt.choice)
+		if tt.err {
+			if err == nil {
+				t.Errorf("resolve(%q) = %s, want an error", tt.choice, got.Mint)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("resolve(%q) failed: %v", tt.choice, err)
+		} else if got.Mint != tt.want {
+			t.Errorf("resolve(%q) = %s, want %s", tt.choice, got.Mint, tt.want)
+		}
+	}
+
+	// the resolved token is a copy, callers cannot change the price book
+	got, err := book.resolve("USDC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got.Amount = 1
+	if again, _ := book.resolve("USDC"); again.Amount != 250_000 {
+		t.Errorf("price book changed through a resolved token, amount %d", again.Amount)
+	}
+}
@@ -0,0 +1,196 @@
+package router
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gagliardetto/solana-go"
+	"github.com/google/uuid"
+	"github.com/router/types"
+)
+
+func (r *Router) newRequestRecord(ip string) *types.RequestRecord {
+	now := time.Now()
+	return &types.RequestRecord{
+		RequestID:   uuid.New().String(),
+		IP:          ip,
+		State:       types.StateCreated,
+		PaymentMode: r.pricing.paymentMode,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(r.lifecycle.ttls[types.StateCreated]),
+	}
+}
+
+// locate broadcasts ip to every gping, collects their answers until every
+// gping answered or the consensus window closes, and resolves the agreed
+// location. A gping answering again is only counted once.
+func (r *Router) locate(requestID, ip string) (*types.PendingRequestIdsValue, error) {
+	// buffered for every gping so a late answer never blocks HandleGPingResponse,
+	// which passes on the first answer of each gping only
+	resultChan := make(chan *types.ResponseFromGping, r.gpingClient.Count())
+	geoReq := &types.RequestToGping{
+		RequestID:   requestID,
+		IP:          ip,
+		ResultChan:  resultChan,
+		BroadcastAt: time.Now(),
+	}
+	r.pendingGeoRequests.Store(requestID, geoReq)
+	defer r.pendingGeoRequests.Delete(requestID)
+
+	r.gpingClient.BroadcastRequest(ip, requestID)
+
+	answers := make([]*types.ResponseFromGping, 0, r.gpingClient.Count())
+	answered := make(map[string]bool, r.gpingClient.Count())
+	window := time.After(r.gpingClient.Window())
+collect:
+	for len(answered) < r.gpingClient.Count() {
+		select {
+		case result := <-resultChan:
+			if answered[result.Gping] {
+				continue
+			}
+			answered[result.Gping] = true
+			answers = append(answers, result)
+		case <-window:
+			break collect
+		}
+	}
+
+	consensus, err := r.gpingClient.Consensus(answers, geoReq.BroadcastAt)
+	if err != nil {
+		r.log.Warn("No geo consensus", "request_id", requestID, "answers", len(answers), "error", err)
+		return nil, fmt.Errorf("no consensus: %v", err)
+	}
+	r.log.Info("Geo consensus reached", "request_id", requestID, "agreeing", len(consensus.Agreeing), "rejected", len(consensus.Rejected), "radius_km", consensus.RadiusKm)
+
+	latitude := strconv.FormatFloat(consensus.Latitude, 'f', -1, 64)
+	longitude := strconv.FormatFloat(consensus.Longitude, 'f', -1, 64)
+	locationInfo, err := r.getLocationInfo(latitude, longitude)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get location info: %v", err)
+	}
+	return &types.PendingRequestIdsValue{
+		DisplayName: locationInfo.DisplayName,
+		Latitude:    latitude,
+		Longitude:   longitude,
+		RadiusKm:    consensus.RadiusKm,
+		Votes:       consensus.Agreeing,
+	}, nil
+}
+
+// resumeRequests reloads the requests that were in flight when the router
+// stopped. Requests still waiting for gpings are broadcast again, and requests
+// whose approval went through are paid out so the gpings are not left unpaid.
+// Their results stay in the store until the request expires.
+func (r *Router) resumeRequests() {
+	records, err := r.requests.List()
+	if err != nil {
+		r.log.Error("Failed to load pending requests", "error", err)
+		return
+	}
+	for _, record := range records {
+		// transactions of the last run that may still land keep their nonce accounts
+		for _, attempt := range []*types.RouterTx{record.PayoutAttempt, record.RefundAttempt} {
+			if attempt != nil && attempt.NonceAccount != "" && r.nonces != nil {
+				if account, err := solana.PublicKeyFromBase58(attempt.NonceAccount); err == nil {
+					r.nonces.hold(account)
+				}
+			}
+		}
+	}
+	for _, record := range records {
+		if record.State.Terminal() || time.Now().After(record.ExpiresAt) {
+			continue
+		}
+		// resumed work is waited for on shutdown like any request in flight
+		if !r.begin() {
+			return
+		}
+		r.log.Info("Resuming request", "request_id", record.RequestID, "state", record.State)
+		go func(record *types.RequestRecord) {
+			defer r.end()
+			r.resumeRequest(record)
+		}(record)
+	}
+}
+
+func (r *Router) resumeRequest(record *types.RequestRecord) {
+	if record.PaymentMode == paymentEscrow || record.PaymentMode == paymentCredits {
+		r.resumePrepaidRequest(record)
+		return
+	}
+	switch record.State {
+	case types.StateCreated, types.StateBroadcast:
+		if record.State == types.StateCreated {
+			if err := r.transition(record, types.StateBroadcast); err != nil {
+				return
+			}
+		}
+		result, err := r.locate(record.RequestID, record.IP)
+		if err != nil {
+			r.transition(record, types.StateFailed)
+			return
+		}
+		record.Result = result
+		r.transition(record, types.StateLocated)
+		return
+	case types.StateAwaitingApproval:
+		if !r.resumeApproval(record) {
+			return
+		}
+	case types.StateApproved:
+	default:
+		return
+	}
+
+	// a payout sent before the restart is settled before another is signed,
+	// and the allowance only covers one fee anyway
+	if err := r.payout(record); err != nil {
+		r.log.Error("Failed to resume payout", "request_id", record.RequestID, "error", err)
+	}
+}
+
+// resumePrepaidRequest carries a request paid upfront on from where it
+// stopped: a funded escrow or debited credit is located, then paid out or
+// given back
+func (r *Router) resumePrepaidRequest(record *types.RequestRecord) {
+	if record.State == types.StateCreated && record.Payment != types.PaymentAuthorized {
+		// the credit was never debited, the request just expires
+		return
+	}
+	if record.State == types.StateAwaitingApproval && !r.resumeApproval(record) {
+		return
+	}
+	switch record.State {
+	case types.StateCreated, types.StateApproved, types.StateBroadcast:
+		if err := r.locatePaid(record); err != nil {
+			return
+		}
+	}
+	if record.State != types.StateLocated {
+		return
+	}
+	// payout first settles every version of a payout sent before the restart:
+	// one on a blockhash is waited for until the blockhash expires, one on a
+	// durable nonce is carried on while the nonce has not moved. Only once none
+	// landed is another signed.
+	if err := r.payout(record); err != nil {
+		r.log.Error("Failed to resume payout", "request_id", record.RequestID, "error", err)
+	}
+}
+
+// resumeApproval waits for the approval or escrow payment a client sent before
+// the restart and moves record to Approved once it landed. It reports whether
+// the request can go on
+func (r *Router) resumeApproval(record *types.RequestRecord) bool {
+	if record.ApprovalTx == "" {
+		// still payable by the client until the request expires
+		return false
+	}
+	if _, err := r.solanaClient.WaitForTransactionConfirmation(record.ApprovalTx); err != nil {
+		r.log.Warn("Payment of resumed request not confirmed", "request_id", record.RequestID, "payment_mode", record.PaymentMode, "error", err)
+		return false
+	}
+	return r.transition(record, types.StateApproved) == nil
+}
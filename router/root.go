@@ -3,6 +3,7 @@ package router
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -19,37 +20,89 @@ import (
 	"github.com/router/keystore"
 	solclient "github.com/router/network/solana"
 	"github.com/router/network/ws"
+	"github.com/router/store"
 )
 
 type Router struct {
 	engine *gin.Engine
+	server *http.Server
 	wsHub  *ws.WSHub
 	solanaClient *solclient.SolanaClient
 	keyPair *solana.PrivateKey
 	port   string
 	pendingGeoRequests sync.Map
-	pendingRequestIds sync.Map
+	requests store.RequestStore
+	requestsLock sync.Mutex
+	lifecycle *lifecycle
 	gpingClient *gping.GpingClient
+	reward config.Reward
+	pricing *priceBook
+	nonces *noncePool
+	ledger store.Ledger
+	credits *credits
+	admin *adminAccess
+	compensating sync.Map // request ids with a compensation in flight
+	quit chan struct{} // closed on shutdown
+	inflightLock sync.Mutex
+	closing bool // guarded by inflightLock
+	inflight sync.WaitGroup // requests, payouts and refunds shutdown waits for
 	log    log.Logger
 }
 
 func NewRouter(cfg *config.Config) *Router {
 	// Initialize Solana client
-    solanaClient := solclient.NewSolanaClient("https://api.devnet.solana.com") 
+    solanaClient, err := solclient.NewSolanaClient(cfg.Solana)
+	if err != nil {
+		panic(err)
+	}
 	keyPair, err := keystore.LoadKeypair(cfg.KeystorePath, cfg.KeystorePassword)
 	if err != nil {
 		panic(err)
 	}
 	gpingClient := gping.NewGpingClient(cfg)
+	pricing, err := newPriceBook(cfg.Pricing, solanaClient)
+	if err != nil {
+		panic(err)
+	}
+	nonces, err := newNoncePool(cfg.Solana.NonceAccounts, keyPair.PublicKey(), solanaClient)
+	if err != nil {
+		panic(err)
+	}
+	requests, err := store.New(cfg.StorePath)
+	if err != nil {
+		panic(err)
+	}
+	ledger, err := store.NewLedger(cfg.StorePath)
+	if err != nil {
+		panic(err)
+	}
+	balances, err := store.NewCreditStore(cfg.StorePath)
+	if err != nil {
+		panic(err)
+	}
+	admin, err := newAdminAccess(cfg.Admin)
+	if err != nil {
+		panic(err)
+	}
 	router := &Router{
 		engine: gin.New(),
-		wsHub:  ws.NewWsHub(),
+		wsHub:  ws.NewWsHub(cfg.WebSocket, newMux(cfg.WebSocket, log.New("module", "websocket"))),
 		solanaClient: solanaClient,
 		keyPair: keyPair,
 		port:   fmt.Sprintf(":%s", cfg.Port),
 		gpingClient: gpingClient,
+		requests: requests,
+		ledger: ledger,
+		credits: newCredits(cfg.Credits, balances),
+		admin:  admin,
+		lifecycle: newLifecycle(cfg.Lifecycle),
+		reward: newRewardConfig(cfg.Reward),
+		pricing: pricing,
+		nonces: nonces,
+		quit:   make(chan struct{}),
 		log:    log.New("module", "server"),
 	}
+	router.server = &http.Server{Addr: router.port, Handler: router.engine}
 	router.engine.Use(gin.Logger())
 	router.engine.Use(gin.Recovery())
 	router.engine.Use(cors.New(cors.Config{
@@ -64,12 +117,21 @@ func NewRouter(cfg *config.Config) *Router {
 		MaxAge: 12 * time.Hour,
 	}))
 	router.registerHandler()
+	router.resumeRequests()
+	go router.reapRequests()
+	if router.credits.enabled {
+		go router.watchDeposits()
+	}
 	return router
 }
 
+// Run serves http until the router is shut down
 func (r *Router) Run() error {
 	r.log.Info("Http server started", "port", r.port)
-	return r.engine.Run(r.port)
+	if err := r.server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
 }
 
 func (r *Router) Resp(c *gin.Context, status int, resp interface{}) {
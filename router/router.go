@@ -3,14 +3,14 @@ package router
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
-	"github.com/gagliardetto/solana-go"
-	"github.com/gagliardetto/solana-go/programs/token"
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
+	solclient "github.com/router/network/solana"
 	"github.com/router/network/ws"
 	"github.com/router/types"
 )
@@ -22,163 +22,231 @@ func (r *Router) registerHandler() {
 	// r.RegisterGETHandler("/ws/call", r.wsFunctionCall)
 	r.RegisterGETHandler("/ws/ip-geo", r.IpGeoInfo)
 	r.RegisterPOSTHandler("/gping/answer", r.HandleGPingResponse)
+	admin := r.engine.Group("/admin", r.admin.authorize)
+	admin.GET("/requests", r.RequestStats)
+	admin.GET("/compensations", r.Compensations)
+	admin.GET("/websocket", r.WebsocketStats)
 
 	//register websocket request handler
-	if err := ws.AddHandler(ws.WsType(1), r.handleIpGeoInfoRequest); err != nil {
+	mux := r.wsHub.Mux()
+	if err := ws.AddHandler(mux, routeIpGeoInfo, r.handleIpGeoInfoRequest); err != nil {
 		r.log.Crit("Failed to add websocket ip geo info request handler", "error", err)
-	} else if err := ws.AddHandler(ws.WsType(2), r.handleSignedTx); err != nil {
+	} else if err := ws.AddHandler(mux, routeSignedTx, r.handleSignedTx); err != nil {
 		r.log.Crit("Failed to add websocket ip geo info request handler", "error", err)
-	} 
+	} else if err := ws.AddHandler(mux, routeCreditBalance, r.handleCreditBalance); err != nil {
+		r.log.Crit("Failed to add websocket credit balance handler", "error", err)
+	} else if err := ws.AddHandler(mux, routeChallenge, r.handleChallenge); err != nil {
+		r.log.Crit("Failed to add websocket challenge handler", "error", err)
+	} else if err := ws.AddHandler(mux, routeAuthenticate, r.handleChallengeResponse); err != nil {
+		r.log.Crit("Failed to add websocket challenge response handler", "error", err)
+	} else if err := ws.AddHandler(mux, routeReclaim, r.handleReclaim); err != nil {
+		r.log.Crit("Failed to add websocket reclaim handler", "error", err)
+	}
 
 }
 
 func (r *Router) IpGeoInfo(c *gin.Context) {
-	if _, err := r.wsHub.AddClient(c); err != nil {
+	if _, err := r.wsHub.AddClient(c); errors.Is(err, ws.ErrUnsupportedVersion) {
+		r.RespError(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+	} else if errors.Is(err, ws.ErrShuttingDown) {
+		r.RespError(c, http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	} else if err != nil {
 		r.RespError(c, http.StatusInternalServerError, err)
 		return
 	}
 }
 
-func (r *Router) handleIpGeoInfoRequest(req interface{}, client *ws.WSClient) (interface{}, error) {
+func (r *Router) handleIpGeoInfoRequest(req *IpGeoInfoRequest, client *ws.WSClient) (*ws.Empty, error) {
+	if !r.begin() {
+		return nil, ws.Errorf(ws.CodeUnavailable, "server is shutting down")
+	}
+	defer r.end()
 	// Step 1: Handle initial IP request
-    ipReq, ok := req.(map[string]interface{})
-    if !ok {
-        return nil, fmt.Errorf("invalid request format")
-    }
-
-    ip, ok := ipReq["ip"].(string)
-    if !ok {
-        return nil, fmt.Errorf("invalid ip format")
-    }
+	ip := req.IP
+	// requests are paid by the wallet the session authenticated with
+	wallet, ok := authenticatedWallet(client)
+	if !ok {
+		return nil, ws.Errorf(ws.CodeUnauthorized, "wallet not authenticated, sign a challenge first")
+	}
+	if req.Wallet != "" && req.Wallet != wallet {
+		return nil, ws.Errorf(ws.CodeUnauthorized, "wallet %s is not the authenticated wallet", req.Wallet)
+	}
+	// the client may choose which accepted token to pay with, by symbol or mint
+	payToken, err := r.pricing.resolve(req.Token)
+	if err != nil {
+		return nil, ws.Errorf(ws.CodeInvalidPayload, "%w", err)
+	}
 	fmt.Println("------------------------STEP1 DONE------------------------")
 	 // Step 2: Send initial response
-	 initialResponse := &types.WsResponse{
+	 initialResponse := &ws.Message{
         Type:    "Initiate",
         Payload: "Pings started looking for your ip geo info. ip : " + ip,
     }
 	
-	if err := r.wsHub.SendToClient(client, initialResponse); err != nil {
+	if err := r.sendToClient(client, initialResponse); err != nil {
         return nil, fmt.Errorf("failed to send initial response: %v", err)
     }
 	fmt.Println("------------------------STEP2 DONE------------------------")
 
 	// Step 3: Braodcast all ip to gpings
-	requestID := uuid.New().String()
-    resultChan := make(chan *types.ResponseFromGping, 1)
-    timeoutChan := make(chan bool, 1)
-	fmt.Println("------------------------REQUEST ID------------------------" + requestID)
-	
-	// Store the request channels
-    geoReq := &types.RequestToGping{
-        RequestID: requestID,
-        IP: ip,
-        ResultChan: resultChan,
-        TimeoutChan: timeoutChan,
-    }
-    r.pendingGeoRequests.Store(requestID, geoReq)
-	defer func() {
-        r.pendingGeoRequests.Delete(requestID)
-        close(resultChan)
-        close(timeoutChan)
-    }()
-
-	 //Broadcast to GPings
-	 r.gpingClient.BroadcastRequest(ip, requestID)
-
-	var result *types.ResponseFromGping
-	select {
-    case result = <-resultChan:
-		
-		locationInfo, err := r.getLocationInfo(result.Latitude, result.Longitude)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get location info: %v", err)
+	record := r.newRequestRecord(ip)
+	record.Mint = payToken.Mint.String()
+	record.Amount = payToken.Amount
+	record.Decimals = payToken.Decimals
+	record.Wallet = wallet
+	record.Session = client.ID()
+	resumeToken, tokenHash, err := newResumeToken()
+	if err != nil {
+		return nil, err
+	}
+	record.ResumeTokenHash = tokenHash
+	if req.Payment == paymentCredits {
+		if !r.credits.enabled {
+			return nil, ws.Errorf(ws.CodeInvalidPayload, "credits are not enabled")
 		}
-		val := &types.PendingRequestIdsValue{
-			DisplayName: locationInfo.DisplayName,
-			VaultAddress: result.Vault,
-            Latitude: result.Latitude,
-            Longitude: result.Longitude,
+		record.PaymentMode = paymentCredits
+	}
+	requestID := record.RequestID
+	fmt.Println("------------------------REQUEST ID------------------------" + requestID)
+	if err := r.saveRequest(record); err != nil {
+		return nil, err
+	}
+	// the token lets the client take the request over to a new connection
+	if err := r.sendToClient(client, &ws.Message{
+		Type:      "requestCreated",
+		RequestID: requestID,
+		Payload:   map[string]interface{}{"resume_token": resumeToken},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to send request id: %v", err)
+	}
+	if record.PaymentMode == paymentCredits {
+		return nil, r.serveFromCredits(record, client)
+	}
+	if record.PaymentMode == paymentEscrow {
+		// paid upfront, the gpings are asked once the escrow is funded
+		if err := r.requestEscrowPayment(record, client); err != nil {
+			return nil, fmt.Errorf("failed to request escrow payment: %v", err)
 		}
-		r.pendingRequestIds.Store(requestID, val)
-    case <-timeoutChan:
-        // Timeout occurred
-        if err := r.wsHub.SendToClient(client, &types.WsResponse{
-            Type: "error",
-            Payload: "Request timed out waiting for GPing response",
-        }); err != nil {
-            return nil, fmt.Errorf("failed to send timeout error: %v", err)
-        }
-    case <-time.After(30 * time.Second):
-        // Backup timeout
-        timeoutChan <- true
-        return nil, fmt.Errorf("request timed out")
-    }
+		return nil, nil
+	}
+	if err := r.transition(record, types.StateBroadcast); err != nil {
+		return nil, err
+	}
+
+	geoResult, err := r.locate(requestID, ip)
+	if err != nil {
+		r.transition(record, types.StateFailed)
+		return nil, ws.Errorf(ws.CodeTimeout, "request timed out waiting for GPing consensus: %w", err).ForRequest(requestID)
+	}
+	record.Result = geoResult
+	if err := r.transition(record, types.StateLocated); err != nil {
+		return nil, err
+	}
 
 	fmt.Println("------------------------STEP3 DONE------------------------")
 	
 	// Step 4. Make raw transaction to send solana network
-	unsignedTx := &types.WsResponseWithRequestID{
+	approvalTx, err := r.buildApprovalTx(record)
+	if err != nil {
+		return nil, err
+	}
+	unsignedTx := &ws.Message{
         Type: "unsignedTx",
 		RequestID: requestID,
         Payload: map[string]interface{}{
-            "program": "TokenkegQfeZyiNwAJbNbGKPFXCWuBvf9Ss623VQ5DA", // Solana Token Program ID
-            "instruction": "Approve",
-            "data": map[string]interface{}{
-                "amount": "1000000000",             // 1 JitoSOL (9 decimals)
-            },
-            "accounts": map[string]string{
-                "source": "Client's JitoSOL token account",      // Client will fill their JitoSOL token account
-                "delegate": r.keyPair.PublicKey().String(),        // Router's public key that will be approved
-                "owner": "Client's wallet address",       // Client will fill their wallet address
-            },
+            "transaction": approvalTx, // base64, to be signed by the client's wallet
+            "mint": record.Mint,
+            "amount": strconv.FormatUint(record.Amount, 10),
+            "decimals": record.Decimals,
+            "delegate": r.keyPair.PublicKey().String(),
+            "last_valid_block_height": record.LastValidBlockHeight,
         },
     }
 
-	if err := r.wsHub.SendToClient(client, unsignedTx); err != nil {
+	if err := r.transition(record, types.StateAwaitingApproval); err != nil {
+		return nil, err
+	}
+	if err := r.sendToClient(client, unsignedTx); err != nil {
         return nil, fmt.Errorf("failed to send unsigned transaction: %v", err)
     }
 	fmt.Println("------------------------STEP4 DONE------------------------")
 	return nil, nil
 }
 
-func (r *Router) handleSignedTx(req interface{}, client *ws.WSClient) (interface{}, error) {
-	// Step 1: execute approval transaction
-	signedTx, ok := req.(map[string]interface{})
-	if !ok {
-		return nil, fmt.Errorf("invalid request format")
+func (r *Router) handleSignedTx(req *SignedTxRequest, client *ws.WSClient) (*ws.Empty, error) {
+	// a payout started before shutdown is waited for, none is started after
+	if !r.begin() {
+		return nil, ws.Errorf(ws.CodeUnavailable, "server is shutting down")
 	}
-	approvalTx, ok := signedTx["signed_tx"].(string)
-    if !ok {
-        return nil, fmt.Errorf("invalid approval tx format")
-    }
+	defer r.end()
+	// Step 1: execute approval transaction
+	approvalTx, requestID := req.SignedTx, req.RequestID
 
-	requestID := signedTx["request_id"].(string)
+	record, err := r.requests.Get(requestID)
+	if err != nil {
+		return nil, ws.Errorf(ws.CodeNotFound, "request id not found")
+	}
+	if err := checkOwner(record, client); err != nil {
+		return nil, err
+	}
+	if record.State != types.StateAwaitingApproval || record.ApprovalTx != "" {
+		return nil, ws.Errorf(ws.CodeInvalidPayload, "request %s is not awaiting approval", requestID)
+	}
 
-	val, ok := r.pendingRequestIds.Load(requestID)
-	if !ok {
-		return nil, fmt.Errorf("request id not found")
+	// only the approval transaction issued for this request may be relayed
+	// and it must be signed by the wallet the session authenticated with
+	decodedTx, err := solclient.DecodeTransaction(approvalTx)
+	if err != nil {
+		err = invalidTx(TxInvalidEncoding, "%v", err)
+	} else if record.PaymentMode == paymentEscrow {
+		err = validateEscrowTx(decodedTx)
+	} else {
+		err = r.validateApprovalTx(decodedTx, record)
 	}
-	geoResult, ok := val.(*types.PendingRequestIdsValue);	
-	if !ok {
-		return nil, fmt.Errorf("invalid requestIds value")
+	if err == nil {
+		err = checkSigner(decodedTx, record.Wallet)
+	}
+	if err == nil {
+		err = checkApprovalTx(decodedTx, record)
+	}
+	if err != nil {
+		r.log.Warn("Rejected client transaction", "request_id", requestID, "error", err)
+		rejected := ws.Errorf(ws.CodeInvalidTransaction, "%w", err).ForRequest(requestID)
+		var txErr *TxValidationError
+		if errors.As(err, &txErr) {
+			rejected.Details = txErr
+		}
+		return nil, rejected
 	}
 
 	approvalTxHash, err := r.solanaClient.SendRawTransaction(approvalTx)
 	if err != nil {
-		r.wsHub.SendToClient(client, &types.WsResponse{
-            Type: "error",
-            Payload: "Failed to submit transaction",
-        })
-        return nil, fmt.Errorf("failed to submit transaction: %v", err)
+        return nil, ws.Errorf(ws.CodePaymentFailed, "failed to submit transaction: %w", err).ForRequest(requestID)
+	}
+	record.ApprovalTx = approvalTxHash
+	r.saveRequest(record)
+
+	ctx, cancel := context.WithTimeout(context.Background(), confirmTimeout)
+	err = r.confirmApproval(ctx, record)
+	cancel()
+	if err != nil && approvalFailed(err) {
+		// the approval can never land, the client has to start over
+		r.transition(record, types.StateFailed)
+	}
+	if err != nil && !approvalFailed(err) {
+		// the reaper settles it once the request expires, the client may
+		// reclaim the request to learn how it ended
+		return nil, ws.Errorf(ws.CodePaymentPending, "approval not confirmed yet: %w", err).ForRequest(requestID)
 	}
-
-	_, err = r.solanaClient.WaitForTransactionConfirmation(approvalTxHash)
     if err != nil {
-        return nil, fmt.Errorf("failed to confirm approval: %v", err)
+        return nil, ws.Errorf(ws.CodePaymentFailed, "failed to confirm approval: %w", err).ForRequest(requestID)
     }
+	if err := r.transition(record, types.StateApproved); err != nil {
+		return nil, err
+	}
 
 
-	if err := r.wsHub.SendToClient(client, &types.WsResponse{
+	if err := r.sendToClient(client, &ws.Message{
         Type: "success",
         Payload: map[string]interface{}{
             "message": "Approval Transaction submitted successfully",
@@ -188,81 +256,16 @@ func (r *Router) handleSignedTx(req interface{}, client *ws.WSClient) (interface
         return nil, fmt.Errorf("failed to send tx hash: %v", approvalTx)
     }
 
-	// Step2 : send transaction that exectutes JitoSOL contract's method "transferFrom".
-	gPingAta, _, err := solana.FindAssociatedTokenAddress(solana.MustPublicKeyFromBase58(geoResult.VaultAddress),solana.MustPublicKeyFromBase58("9JUomKyopNpak1kZvBA6taUfV9rJxctLeFB8ac2iFDaH") )
-	if err != nil {
-		return nil, fmt.Errorf("failed to get associated token address: %v", err)
-	}
-	transferInstruction := token.NewTransferCheckedInstruction(
-        1_000_000_000,                                             // amount: 1 JitoSOL
-        9,                                                         // decimals
-        solana.MustPublicKeyFromBase58("AHDHUrKFvYmrAm2cLScAD4xp9UFjw5JcEdAo19ofvUjZ"),    // source
-        solana.MustPublicKeyFromBase58("9JUomKyopNpak1kZvBA6taUfV9rJxctLeFB8ac2iFDaH"),     // mint
-		gPingAta,   // destination ==  gping 주소의 토큰계정
-        r.keyPair.PublicKey(),                              // authority (Router)
-        []solana.PublicKey{},                                     // signers
-    ).Build()
-
-	// Create the transaction
-    recent, err := r.solanaClient.GetRecentBlockhash(context.Background())
-    if err != nil {
-        return nil, fmt.Errorf("failed to get recent blockhash: %v", err)
-    }
-
-    tx, err := solana.NewTransaction(
-        []solana.Instruction{transferInstruction},
-        recent.Value.Blockhash,
-        solana.TransactionPayer(r.keyPair.PublicKey()),
-    )
-    if err != nil {
-        return nil, fmt.Errorf("failed to create transaction: %v", err)
-    }
-
-    // Sign the transaction
-    _, err = tx.Sign(func(key solana.PublicKey) *solana.PrivateKey {
-        if key.Equals(r.keyPair.PublicKey()) {
-            return r.keyPair
-        }
-        return nil
-    })
-    if err != nil {
-        return nil, fmt.Errorf("failed to sign transaction: %v", err)
-    }
-
-    // Send the transfer transaction
-    transferTxHash, err := r.solanaClient.SendTransaction(context.Background(), tx)
-    if err != nil {
-        r.wsHub.SendToClient(client, &types.WsResponse{
-            Type: "error",
-            Payload: "Failed to execute transfer",
-        })
-        return nil, fmt.Errorf("failed to submit transfer: %v", err)
-    }
-
-    // Wait for transfer confirmation
-    _, err = r.solanaClient.WaitForTransactionConfirmation(transferTxHash)
-    if err != nil {
-        r.wsHub.SendToClient(client, &types.WsResponse{
-            Type: "error",
-            Payload: "Failed to confirm transfer",
-        })
-        return nil, fmt.Errorf("failed to confirm transfer: %v", err)
-    }
-
-    // Send success response
-    if err := r.wsHub.SendToClient(client, &types.WsResponse{
-        Type: "result",
-        Payload: map[string]interface{}{
-			"geoResult": geoResult.DisplayName,
-            "latitude": geoResult.Latitude,
-            "longitude": geoResult.Longitude,
-        },
-    }); err != nil {
-        return nil, fmt.Errorf("failed to send success message: %v", err)
-    }
-
-    return nil, nil
+	if record.PaymentMode == paymentEscrow {
+		if err := r.locatePaid(record); err != nil {
+			return nil, ws.Errorf(ws.CodeTimeout, "request timed out waiting for GPing consensus, the escrow is refunded: %w", err).ForRequest(requestID)
+		}
+	}
 
+	if err := r.deliver(record, client); err != nil {
+		return nil, err
+	}
+	return nil, nil
 }
 
 func (r *Router) HandleGPingResponse(c *gin.Context) {
@@ -271,23 +274,93 @@ func (r *Router) HandleGPingResponse(c *gin.Context) {
         c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
         return
     }
+	if err := r.gpingClient.VerifyResponse(&response); err != nil {
+		r.log.Warn("Rejected gping answer", "request_id", response.RequestID, "gping", response.Gping, "vault", response.Vault, "error", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
 
     // Look up the pending request
     if reqInterface, ok := r.pendingGeoRequests.Load(response.RequestID); ok {
         req := reqInterface.(*types.RequestToGping)
+		if _, repeated := req.Answered.LoadOrStore(response.Gping, true); repeated {
+			c.JSON(http.StatusConflict, gin.H{"error": "Answer already received"})
+			return
+		}
         // Send the response to the waiting channel
-        req.ResultChan <- &types.ResponseFromGping{
+        select {
+        case req.ResultChan <- &types.ResponseFromGping{
 			Latitude: response.Latitude,
 			Longitude: response.Longitude,
 			Vault: response.Vault,
 			RequestID: response.RequestID,
-		}
-        c.JSON(http.StatusOK, gin.H{"status": "success"})
+			Gping: response.Gping,
+			Signature: response.Signature,
+			ReceivedAt: time.Now(),
+		}:
+            c.JSON(http.StatusOK, gin.H{"status": "success"})
+        default:
+            c.JSON(http.StatusConflict, gin.H{"error": "Request no longer accepts answers"})
+        }
     } else {
         c.JSON(http.StatusNotFound, gin.H{"error": "Request not found"})
     }
 }
 
+// deliver pays the gpings of a located request its client paid for and sends
+// the client the result. A client whose payment cannot be paid out is
+// compensated, and the error returned is the one to answer it with.
+func (r *Router) deliver(record *types.RequestRecord, client *ws.WSClient) error {
+	// Step2 : send transaction that exectutes JitoSOL contract's method "transferFrom",
+	// from the client's approved account, its escrow or the router's deposit account.
+	// The fee is split between every gping that agreed on the answer, all in one transaction.
+	if err := r.payout(record); err != nil {
+		failed := ws.Errorf(ws.CodePaymentFailed, "failed to execute transfer: %w", err).ForRequest(record.RequestID)
+		if record.PayoutAttempt != nil {
+			// the payout may still land, resuming or expiring the request settles it
+			return failed
+		}
+		if compErr := r.compensate(record, fmt.Sprintf("payout failed: %v", err), r.clientOf(record, client)); compErr != nil {
+			r.log.Error("Failed to compensate request", "request_id", record.RequestID, "error", compErr)
+		}
+		if !record.State.Terminal() {
+			r.transition(record, types.StateFailed)
+		}
+		return failed
+	}
+
+    // Send success response, to the session that owns the request by now
+    if err := r.sendToClient(r.clientOf(record, client), &ws.Message{
+        Type: "result",
+        Payload: resultPayload(record.Result),
+    }); err != nil {
+        return fmt.Errorf("failed to send success message: %v", err)
+    }
+	// a client that dropped has the result queued on its session and is
+	// replayed it if it resumes, or may reclaim it with its resume token
+	r.transition(record, types.StateDelivered)
+	return nil
+}
+
+
+func resultPayload(geoResult *types.PendingRequestIdsValue) map[string]interface{} {
+	return map[string]interface{}{
+		"geoResult": geoResult.DisplayName,
+		"latitude":  geoResult.Latitude,
+		"longitude": geoResult.Longitude,
+		"radius_km": geoResult.RadiusKm,
+		"vaults":    vaultsOf(geoResult.Votes),
+	}
+}
+
+func vaultsOf(votes []types.GpingVote) []string {
+	vaults := make([]string, len(votes))
+	for i, v := range votes {
+		vaults[i] = v.Vault
+	}
+	return vaults
+}
+
 func (r *Router) getLocationInfo(lat, lon string) (*types.NominatimResponse, error) {
     url := fmt.Sprintf(
         "https://nominatim.openstreetmap.org/reverse?lat=%s&lon=%s&format=json",
@@ -0,0 +1,127 @@
+package router
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/router/network/ws"
+	"github.com/router/types"
+)
+
+// newResumeToken returns a token the client can reclaim a request with after
+// reconnecting, and the hash of it that is stored with the request
+func newResumeToken() (string, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", fmt.Errorf("failed to generate resume token: %v", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	return token, hashResumeToken(token), nil
+}
+
+func hashResumeToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// clientOf returns the session owning record, or fallback if the owner is
+// gone. fallback is preferred when it is the owner, as its messages carry the
+// id of the message it is handling.
+func (r *Router) clientOf(record *types.RequestRecord, fallback *ws.WSClient) *ws.WSClient {
+	if fallback != nil && fallback.ID() == record.Session {
+		return fallback
+	}
+	if client, ok := r.wsHub.Client(record.Session); ok {
+		return client
+	}
+	return fallback
+}
+
+// sendToClient sends message to client. A client that is away is not an
+// error: its session keeps the message and replays it once the client
+// resumes, and a client that does not may still reclaim the request.
+func (r *Router) sendToClient(client *ws.WSClient, message *ws.Message) error {
+	if err := r.wsHub.SendToClient(client, message); err != nil && !errors.Is(err, ws.ErrDisconnected) {
+		return err
+	}
+	return nil
+}
+
+// checkOwner rejects access to a request from any session but the one that
+// created or reclaimed it
+func checkOwner(record *types.RequestRecord, client *ws.WSClient) error {
+	if record.Session != client.ID() {
+		return ws.Errorf(ws.CodeUnauthorized, "request %s belongs to another session", record.RequestID)
+	}
+	if wallet, ok := authenticatedWallet(client); !ok || wallet != record.Wallet {
+		return ws.Errorf(ws.CodeUnauthorized, "request %s does not belong to the authenticated wallet", record.RequestID)
+	}
+	return nil
+}
+
+// handleReclaim : ws api moving a request to the calling session. The client
+// proves it owns the request with the resume token it got on creation, and
+// must be authenticated with the request's wallet. The reply carries the
+// request's state and whatever the client still has to act on: the issued
+// transaction while payment is awaited, or the result once it is paid.
+func (r *Router) handleReclaim(req *ReclaimRequest, client *ws.WSClient) (*ws.Empty, error) {
+	requestID, token := req.RequestID, req.ResumeToken
+
+	record, err := r.requests.Get(requestID)
+	if err != nil {
+		return nil, ws.Errorf(ws.CodeNotFound, "request id not found")
+	}
+	if record.ResumeTokenHash == "" || subtle.ConstantTimeCompare([]byte(hashResumeToken(token)), []byte(record.ResumeTokenHash)) != 1 {
+		return nil, ws.Errorf(ws.CodeUnauthorized, "invalid resume token for request %s", requestID)
+	}
+	if wallet, ok := authenticatedWallet(client); !ok || wallet != record.Wallet {
+		return nil, ws.Errorf(ws.CodeUnauthorized, "request %s does not belong to the authenticated wallet", requestID)
+	}
+
+	// the request may be paid out or delivered meanwhile, only its session is
+	// changed so that their saves are not overwritten with this older copy
+	record, previous, err := r.reassignRequest(requestID, client.ID())
+	if err != nil {
+		return nil, err
+	}
+	r.log.Info("Request reclaimed", "request_id", requestID, "from", previous, "to", client.ID())
+
+	payload := map[string]interface{}{
+		"state":   record.State,
+		"payment": record.Payment,
+	}
+	if record.State == types.StateAwaitingApproval && record.ApprovalTx == "" {
+		issued, err := r.issuedTx(record)
+		if err != nil {
+			return nil, err
+		}
+		payload["transaction"] = issued
+		payload["last_valid_block_height"] = record.LastValidBlockHeight
+	}
+	paid := record.State == types.StatePaid || record.State == types.StateDelivered
+	if paid && record.Result != nil {
+		payload["result"] = resultPayload(record.Result)
+	}
+	if err := r.sendToClient(client, &ws.Message{
+		Type:      "reclaimed",
+		RequestID: requestID,
+		Payload:   payload,
+	}); err != nil {
+		return nil, err
+	}
+	if record.State == types.StatePaid {
+		r.transition(record, types.StateDelivered)
+	}
+	return nil, nil
+}
+
+// WebsocketStats : admin api returning the counters of the websocket hub and of every session
+func (r *Router) WebsocketStats(c *gin.Context) {
+	r.RespOK(c, gin.H{"hub": r.wsHub.Stats(), "clients": r.wsHub.ClientStats()})
+}
@@ -0,0 +1,91 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// begin registers work that has to finish before the router shuts down, and
+// reports false once it is shutting down and takes no new work
+func (r *Router) begin() bool {
+	r.inflightLock.Lock()
+	defer r.inflightLock.Unlock()
+	if r.closing {
+		return false
+	}
+	r.inflight.Add(1)
+	return true
+}
+
+func (r *Router) end() {
+	r.inflight.Done()
+}
+
+// stopping reports whether the router is shutting down
+func (r *Router) stopping() bool {
+	select {
+	case <-r.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown stops the router gracefully. New connections and requests are
+// refused and connected clients are told the server is going away; requests
+// in flight, payouts and refunds included, are given until ctx is done to
+// finish. Then the connections, the http server and the rpc health checks
+// are stopped, and the stores flushed, unless requests are still in flight:
+// those may still write to them, so the stores are left for the process exit
+// to close.
+func (r *Router) Shutdown(ctx context.Context) error {
+	r.inflightLock.Lock()
+	if r.closing {
+		r.inflightLock.Unlock()
+		return fmt.Errorf("router already shut down")
+	}
+	r.closing = true
+	close(r.quit)
+	r.inflightLock.Unlock()
+
+	notified := r.wsHub.Shutdown("server shutting down")
+	r.log.Info("Shutting down", "notified", notified)
+
+	drained := make(chan struct{})
+	go func() {
+		r.inflight.Wait()
+		close(drained)
+	}()
+	inflight := false
+	select {
+	case <-drained:
+		r.log.Info("Requests in flight finished")
+	case <-ctx.Done():
+		// their records keep the state they reached, resumeRequests picks them up on restart
+		r.log.Warn("Requests still in flight at shutdown", "error", ctx.Err())
+		inflight = true
+	}
+
+	r.wsHub.Close("server shutting down")
+	var errs []error
+	if err := r.server.Shutdown(ctx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		errs = append(errs, fmt.Errorf("failed to shut down http server: %v", err))
+	}
+	r.solanaClient.Close()
+	if inflight {
+		r.log.Warn("Stores left open for the requests still in flight")
+		return errors.Join(errs...)
+	}
+	if err := r.requests.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to close request store: %v", err))
+	}
+	if err := r.ledger.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to close ledger: %v", err))
+	}
+	if err := r.credits.balances.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to close credit store: %v", err))
+	}
+	return errors.Join(errs...)
+}
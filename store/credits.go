@@ -0,0 +1,284 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/router/types"
+)
+
+const (
+	creditSnapshotFile = "balances.json"
+	creditLogFile      = "movements.jsonl"
+	// how long a return is remembered to keep it from being given twice,
+	// well past the retention of the request it belongs to
+	returnRetention = 7 * 24 * time.Hour
+)
+
+var ErrInsufficientCredit = errors.New("insufficient credit")
+
+// CreditStore keeps the prepaid credit balances of client wallets, in base
+// units per mint, with the deposits and movements that make them up
+type CreditStore interface {
+	// Balances returns the balance of wallet per mint
+	Balances(wallet string) (map[string]uint64, error)
+	// Deposit credits a deposit once, it returns false if its signature was already credited
+	Deposit(deposit *types.CreditDeposit) (bool, error)
+	// Debit takes amount from the balance, or fails with ErrInsufficientCredit
+	Debit(wallet, mint string, amount uint64, requestID string) error
+	// Return gives back the debit of a request, at most once
+	Return(wallet, mint string, amount uint64, requestID string) error
+	// Cursor is the newest transaction of a deposit account already scanned,
+	// ok is false if the account was never scanned
+	Cursor(account string) (signature string, ok bool)
+	// SetCursor moves the cursor of account past every deposit credited to it
+	SetCursor(account, signature string) error
+	Close() error
+}
+
+// creditSnapshot is the state of the balances once the first LogSize bytes of
+// the log are applied
+type creditSnapshot struct {
+	Balances map[string]map[string]uint64 `json:"balances"` // wallet, mint
+	Cursors  map[string]string            `json:"cursors"`
+	// deposits credited but not yet behind the cursor of their account, which
+	// a scan may list again, by signature
+	Recent   map[string]string    `json:"recent"`   // deposit account
+	Returned map[string]time.Time `json:"returned"` // by request id
+	LogSize  int64                `json:"log_size"`
+}
+
+// creditEntry is a line of the log, either a deposit or a movement
+type creditEntry struct {
+	Deposit  *types.CreditDeposit  `json:"deposit,omitempty"`
+	Movement *types.CreditMovement `json:"movement,omitempty"`
+}
+
+// creditStore holds every balance in memory and, unless log is nil, appends
+// every deposit and movement to the log, as the ledger does, before applying
+// it. Balances and cursors are saved as a snapshot whenever a cursor moves, so
+// opening the store only replays the log written since.
+type creditStore struct {
+	lock     sync.Mutex
+	path     string // of the snapshot
+	log      *os.File
+	snapshot creditSnapshot
+}
+
+// NewCreditStore opens the credit balances kept in dir, or in memory when dir is empty
+func NewCreditStore(dir string) (CreditStore, error) {
+	s := &creditStore{snapshot: creditSnapshot{
+		Balances: make(map[string]map[string]uint64),
+		Cursors:  make(map[string]string),
+		Recent:   make(map[string]string),
+		Returned: make(map[string]time.Time),
+	}}
+	if dir == "" {
+		return s, nil
+	}
+
+	// a subdirectory, so the request store does not take the files for requests
+	creditDir := filepath.Join(dir, "credits")
+	if err := os.MkdirAll(creditDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create credit directory: %v", err)
+	}
+	s.path = filepath.Join(creditDir, creditSnapshotFile)
+	data, err := os.ReadFile(s.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read credits: %v", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &s.snapshot); err != nil {
+			return nil, fmt.Errorf("failed to parse credits: %v", err)
+		}
+	}
+	// snapshots of older versions lack the maps they did not keep
+	if s.snapshot.Recent == nil {
+		s.snapshot.Recent = make(map[string]string)
+	}
+	if s.snapshot.Returned == nil {
+		s.snapshot.Returned = make(map[string]time.Time)
+	}
+
+	s.log, err = os.OpenFile(filepath.Join(creditDir, creditLogFile), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open credit log: %v", err)
+	}
+	if err := s.replay(); err != nil {
+		s.log.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// replay applies the entries logged after the snapshot
+func (s *creditStore) replay() error {
+	if _, err := s.log.Seek(s.snapshot.LogSize, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek credit log: %v", err)
+	}
+	scanner := bufio.NewScanner(s.log)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		s.snapshot.LogSize += int64(len(scanner.Bytes())) + 1
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry creditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return fmt.Errorf("failed to parse credit log line %d after the snapshot: %v", line, err)
+		}
+		s.apply(&entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read credit log: %v", err)
+	}
+	return nil
+}
+
+func (s *creditStore) Balances(wallet string) (map[string]uint64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	balances := make(map[string]uint64, len(s.snapshot.Balances[wallet]))
+	for mint, amount := range s.snapshot.Balances[wallet] {
+		balances[mint] = amount
+	}
+	return balances, nil
+}
+
+func (s *creditStore) Deposit(deposit *types.CreditDeposit) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.snapshot.Recent[deposit.Signature]; ok {
+		return false, nil
+	}
+	copied := *deposit
+	if err := s.append(&creditEntry{Deposit: &copied}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *creditStore) Debit(wallet, mint string, amount uint64, requestID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.snapshot.Balances[wallet][mint] < amount {
+		return ErrInsufficientCredit
+	}
+	return s.append(&creditEntry{Movement: newMovement(types.CreditDebit, wallet, mint, amount, requestID)})
+}
+
+func (s *creditStore) Return(wallet, mint string, amount uint64, requestID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.snapshot.Returned[requestID]; ok {
+		return nil
+	}
+	return s.append(&creditEntry{Movement: newMovement(types.CreditReturn, wallet, mint, amount, requestID)})
+}
+
+func (s *creditStore) Cursor(account string) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	signature, ok := s.snapshot.Cursors[account]
+	return signature, ok
+}
+
+func (s *creditStore) SetCursor(account, signature string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.snapshot.Cursors[account] = signature
+	// a scan from the new cursor cannot list them again
+	for sig, depositAccount := range s.snapshot.Recent {
+		if depositAccount == account {
+			delete(s.snapshot.Recent, sig)
+		}
+	}
+	for requestID, at := range s.snapshot.Returned {
+		if time.Since(at) > returnRetention {
+			delete(s.snapshot.Returned, requestID)
+		}
+	}
+	return s.save()
+}
+
+func (s *creditStore) Close() error {
+	if s.log == nil {
+		return nil
+	}
+	return s.log.Close()
+}
+
+func newMovement(kind, wallet, mint string, amount uint64, requestID string) *types.CreditMovement {
+	return &types.CreditMovement{
+		Kind:      kind,
+		RequestID: requestID,
+		Wallet:    wallet,
+		Mint:      mint,
+		Amount:    amount,
+		At:        time.Now(),
+	}
+}
+
+// append logs entry and syncs the log, then applies it. Callers must hold lock.
+func (s *creditStore) append(entry *creditEntry) error {
+	if s.log != nil {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("failed to encode credit entry: %v", err)
+		}
+		data = append(data, '\n')
+		if _, err := s.log.Write(data); err != nil {
+			return fmt.Errorf("failed to write credit log: %v", err)
+		}
+		if err := s.log.Sync(); err != nil {
+			return fmt.Errorf("failed to sync credit log: %v", err)
+		}
+		s.snapshot.LogSize += int64(len(data))
+	}
+	s.apply(entry)
+	return nil
+}
+
+// apply changes the balances by a logged entry
+func (s *creditStore) apply(entry *creditEntry) {
+	if d := entry.Deposit; d != nil {
+		s.snapshot.Recent[d.Signature] = d.Account
+		s.add(d.Wallet, d.Mint, d.Amount)
+	}
+	if m := entry.Movement; m != nil {
+		switch m.Kind {
+		case types.CreditDebit:
+			s.add(m.Wallet, m.Mint, 0)
+			s.snapshot.Balances[m.Wallet][m.Mint] -= m.Amount
+		case types.CreditReturn:
+			s.snapshot.Returned[m.RequestID] = m.At
+			s.add(m.Wallet, m.Mint, m.Amount)
+		}
+	}
+}
+
+func (s *creditStore) add(wallet, mint string, amount uint64) {
+	if s.snapshot.Balances[wallet] == nil {
+		s.snapshot.Balances[wallet] = make(map[string]uint64)
+	}
+	s.snapshot.Balances[wallet][mint] += amount
+}
+
+// save writes the snapshot to disk. Callers must hold lock.
+func (s *creditStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(&s.snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to encode credits: %v", err)
+	}
+	return writeFileAtomic(s.path, data)
+}
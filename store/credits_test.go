@@ -0,0 +1,172 @@
+package store
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/router/types"
+)
+
+const (
+	testWallet  = "wallet"
+	testMint    = "mint"
+	testAccount = "deposit-account"
+)
+
+func deposit(signature string, amount uint64) *types.CreditDeposit {
+	return &types.CreditDeposit{Signature: signature, Account: testAccount, Wallet: testWallet, Mint: testMint, Amount: amount}
+}
+
+func balance(t *testing.T, s CreditStore) uint64 {
+	t.Helper()
+	balances, err := s.Balances(testWallet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return balances[testMint]
+}
+
+func mustDeposit(t *testing.T, s CreditStore, d *types.CreditDeposit, want bool) {
+	t.Helper()
+	credited, err := s.Deposit(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credited != want {
+		t.Fatalf("deposit %s credited %v, want %v", d.Signature, credited, want)
+	}
+}
+
+func TestCreditStoreReplay(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewCreditStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// before the snapshot
+	mustDeposit(t, s, deposit("sig-1", 100), true)
+	if err := s.Debit(testWallet, testMint, 30, "request-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetCursor(testAccount, "sig-1"); err != nil {
+		t.Fatal(err)
+	}
+	// only in the log
+	mustDeposit(t, s, deposit("sig-2", 50), true)
+	if err := s.Debit(testWallet, testMint, 40, "request-2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Return(testWallet, testMint, 40, "request-2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Debit(testWallet, testMint, 5, "request-3"); err != nil {
+		t.Fatal(err)
+	}
+	want, err := s.Balances(testWallet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want[testMint] != 115 {
+		t.Fatalf("balance %d before reopening, want 115", want[testMint])
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewCreditStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	got, err := reopened.Balances(testWallet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("balances %v after reopening, want %v", got, want)
+	}
+	if cursor, ok := reopened.Cursor(testAccount); !ok || cursor != "sig-1" {
+		t.Errorf("cursor %q, %v after reopening, want sig-1", cursor, ok)
+	}
+	if _, ok := reopened.Cursor("other-account"); ok {
+		t.Error("cursor of an account never scanned")
+	}
+
+	// a rescan from the cursor lists the deposit of the log again
+	mustDeposit(t, reopened, deposit("sig-2", 50), false)
+	if err := reopened.Return(testWallet, testMint, 40, "request-2"); err != nil {
+		t.Fatal(err)
+	}
+	if b := balance(t, reopened); b != 115 {
+		t.Errorf("balance %d after replaying a deposit and a return, want 115", b)
+	}
+
+	// moving the cursor snapshots the replayed state
+	if err := reopened.SetCursor(testAccount, "sig-2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Close(); err != nil {
+		t.Fatal(err)
+	}
+	again, err := NewCreditStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	if b := balance(t, again); b != 115 {
+		t.Errorf("balance %d after reopening from the new snapshot, want 115", b)
+	}
+}
+
+func TestCreditStoreDebit(t *testing.T) {
+	for _, dir := range []string{"", t.TempDir()} {
+		s, err := NewCreditStore(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Debit(testWallet, testMint, 1, "request-0"); !errors.Is(err, ErrInsufficientCredit) {
+			t.Errorf("debit of a wallet without credit: %v, want ErrInsufficientCredit", err)
+		}
+		mustDeposit(t, s, deposit("sig-1", 10), true)
+		if err := s.Debit(testWallet, testMint, 11, "request-1"); !errors.Is(err, ErrInsufficientCredit) {
+			t.Errorf("overdraw: %v, want ErrInsufficientCredit", err)
+		}
+		if b := balance(t, s); b != 10 {
+			t.Errorf("balance %d after a refused debit, want 10", b)
+		}
+		if err := s.Debit(testWallet, testMint, 10, "request-2"); err != nil {
+			t.Errorf("debit of the whole balance: %v", err)
+		}
+		if err := s.Debit(testWallet, testMint, 1, "request-3"); !errors.Is(err, ErrInsufficientCredit) {
+			t.Errorf("debit of an empty balance: %v, want ErrInsufficientCredit", err)
+		}
+		if b := balance(t, s); b != 0 {
+			t.Errorf("balance %d, want 0", b)
+		}
+		s.Close()
+	}
+}
+
+func TestCreditStoreReturnOnce(t *testing.T) {
+	for _, dir := range []string{"", t.TempDir()} {
+		s, err := NewCreditStore(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mustDeposit(t, s, deposit("sig-1", 10), true)
+		if err := s.Debit(testWallet, testMint, 4, "request-1"); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := s.Return(testWallet, testMint, 4, "request-1"); err != nil {
+				t.Fatalf("return %d: %v", i+1, err)
+			}
+			if b := balance(t, s); b != 10 {
+				t.Errorf("balance %d after return %d, want 10", b, i+1)
+			}
+		}
+		s.Close()
+	}
+}
@@ -0,0 +1,130 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/router/types"
+)
+
+const recordExt = ".json"
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9-]{1,64}$`)
+
+// fileStore keeps one json file per request in a directory and serves reads
+// from memory. Every write goes through a temp file and a rename, so a crash
+// leaves either the old or the new record on disk, never a torn one.
+type fileStore struct {
+	dir   string
+	cache *memoryStore
+}
+
+// NewFileStore opens the store in dir and loads every request found there
+func NewFileStore(dir string) (RequestStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create store directory: %v", err)
+	}
+	s := &fileStore{dir: dir, cache: NewMemoryStore().(*memoryStore)}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read store directory: %v", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), recordExt) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", entry.Name(), err)
+		}
+		var record types.RequestRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", entry.Name(), err)
+		}
+		s.cache.records[record.RequestID] = &record
+	}
+	return s, nil
+}
+
+func (s *fileStore) path(requestID string) (string, error) {
+	if !validRequestID.MatchString(requestID) {
+		return "", fmt.Errorf("invalid request id %q", requestID)
+	}
+	return filepath.Join(s.dir, requestID+recordExt), nil
+}
+
+func (s *fileStore) Get(requestID string) (*types.RequestRecord, error) {
+	return s.cache.Get(requestID)
+}
+
+func (s *fileStore) Put(record *types.RequestRecord) error {
+	path, err := s.path(record.RequestID)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	s.cache.lock.Lock()
+	defer s.cache.lock.Unlock()
+	if err := writeFileAtomic(path, data); err != nil {
+		return err
+	}
+	copied := *record
+	s.cache.records[record.RequestID] = &copied
+	return nil
+}
+
+func (s *fileStore) Delete(requestID string) error {
+	path, err := s.path(requestID)
+	if err != nil {
+		return err
+	}
+
+	s.cache.lock.Lock()
+	defer s.cache.lock.Unlock()
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete request: %v", err)
+	}
+	delete(s.cache.records, requestID)
+	return nil
+}
+
+func (s *fileStore) List() ([]*types.RequestRecord, error) {
+	return s.cache.List()
+}
+
+func (s *fileStore) Close() error {
+	return nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temp file: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync temp file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace request file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/router/types"
+)
+
+const ledgerFile = "ledger.jsonl"
+
+// Ledger is an append-only audit log of compensations. Entries are never
+// changed or removed; a later step of the same compensation is a new entry.
+type Ledger interface {
+	Append(entry *types.LedgerEntry) error
+	List() ([]*types.LedgerEntry, error)
+	Close() error
+}
+
+// NewLedger opens the ledger file in dir, or an in-memory ledger when dir is empty
+func NewLedger(dir string) (Ledger, error) {
+	if dir == "" {
+		return &memoryLedger{}, nil
+	}
+	return NewFileLedger(dir)
+}
+
+type memoryLedger struct {
+	lock    sync.RWMutex
+	entries []*types.LedgerEntry
+}
+
+func (l *memoryLedger) Append(entry *types.LedgerEntry) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	copied := *entry
+	l.entries = append(l.entries, &copied)
+	return nil
+}
+
+func (l *memoryLedger) List() ([]*types.LedgerEntry, error) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	entries := make([]*types.LedgerEntry, len(l.entries))
+	for i, entry := range l.entries {
+		copied := *entry
+		entries[i] = &copied
+	}
+	return entries, nil
+}
+
+func (l *memoryLedger) Close() error {
+	return nil
+}
+
+// fileLedger appends one json line per entry to a file opened in append mode
+// and syncs it before Append returns
+type fileLedger struct {
+	file  *os.File
+	cache *memoryLedger
+}
+
+// NewFileLedger opens the ledger in dir and loads its entries
+func NewFileLedger(dir string) (Ledger, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create ledger directory: %v", err)
+	}
+	path := filepath.Join(dir, ledgerFile)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ledger: %v", err)
+	}
+
+	l := &fileLedger{file: file, cache: &memoryLedger{}}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry types.LedgerEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to parse ledger line %d: %v", line, err)
+		}
+		l.cache.entries = append(l.cache.entries, &entry)
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read ledger: %v", err)
+	}
+	return l, nil
+}
+
+func (l *fileLedger) Append(entry *types.LedgerEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode ledger entry: %v", err)
+	}
+
+	l.cache.lock.Lock()
+	defer l.cache.lock.Unlock()
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write ledger: %v", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync ledger: %v", err)
+	}
+	copied := *entry
+	l.cache.entries = append(l.cache.entries, &copied)
+	return nil
+}
+
+func (l *fileLedger) List() ([]*types.LedgerEntry, error) {
+	return l.cache.List()
+}
+
+func (l *fileLedger) Close() error {
+	return l.file.Close()
+}
@@ -0,0 +1,77 @@
+package store
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/router/types"
+)
+
+var ErrNotFound = errors.New("request not found")
+
+// RequestStore keeps the state of ip geo requests
+type RequestStore interface {
+	Get(requestID string) (*types.RequestRecord, error)
+	Put(record *types.RequestRecord) error
+	Delete(requestID string) error
+	List() ([]*types.RequestRecord, error)
+	Close() error
+}
+
+// New opens a file store in dir, or an in-memory store when dir is empty
+func New(dir string) (RequestStore, error) {
+	if dir == "" {
+		return NewMemoryStore(), nil
+	}
+	return NewFileStore(dir)
+}
+
+type memoryStore struct {
+	lock    sync.RWMutex
+	records map[string]*types.RequestRecord
+}
+
+// NewMemoryStore returns a store that loses every request on restart
+func NewMemoryStore() RequestStore {
+	return &memoryStore{records: make(map[string]*types.RequestRecord)}
+}
+
+func (s *memoryStore) Get(requestID string) (*types.RequestRecord, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if record, ok := s.records[requestID]; ok {
+		copied := *record
+		return &copied, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryStore) Put(record *types.RequestRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	copied := *record
+	s.records[record.RequestID] = &copied
+	return nil
+}
+
+func (s *memoryStore) Delete(requestID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.records, requestID)
+	return nil
+}
+
+func (s *memoryStore) List() ([]*types.RequestRecord, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	records := make([]*types.RequestRecord, 0, len(s.records))
+	for _, record := range s.records {
+		copied := *record
+		records = append(records, &copied)
+	}
+	return records, nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
@@ -1,5 +1,9 @@
 package types
 
+import (
+	"sync"
+	"time"
+)
 
 type ParamInfo struct {
     Name  string `json:"Name"`
@@ -15,22 +19,12 @@ type SendTxRequest struct {
 	Tx string `json:"tx"`
 }
 
-type WsResponse struct {
-    Type    string    `json:"type"`
-    Payload interface{} `json:"payload"`
-}
-
-type WsResponseWithRequestID struct {
-    Type    string    `json:"type"`
-    Payload interface{} `json:"payload"`
-	RequestID string `json:"request_id"`
-}
-
 type RequestToGping struct {
     RequestID string
     IP        string
     ResultChan chan *ResponseFromGping
-    TimeoutChan chan bool
+    BroadcastAt time.Time
+	Answered sync.Map // addresses of the gpings that answered, only their first answer counts
 }
 
 type ResponseFromGping struct {
@@ -38,6 +32,32 @@ type ResponseFromGping struct {
     Longitude string   `json:"longitude"`      
 	Vault    string `json:"vault"` // Vault contract address`
 	RequestID string `json:"request_id"`
+	Gping string `json:"gping"` // address of the answering gping
+	Signature string `json:"signature"` // base58 ed25519 signature of SigningMessage by Gping
+	ReceivedAt time.Time `json:"-"`
+}
+
+// SigningMessage returns the bytes a gping signs to vouch for its answer
+func (r *ResponseFromGping) SigningMessage() []byte {
+	return []byte(r.RequestID + ":" + r.Latitude + ":" + r.Longitude + ":" + r.Vault)
+}
+
+// GpingVote is one gping answer that took part in a consensus
+type GpingVote struct {
+	Vault      string        `json:"vault"`
+	Latitude   float64       `json:"latitude"`
+	Longitude  float64       `json:"longitude"`
+	DistanceKm float64       `json:"distance_km"` // distance from the consensus location
+	Latency    time.Duration `json:"latency"`
+}
+
+// GeoConsensus is the location agreed on by a quorum of gpings
+type GeoConsensus struct {
+	Latitude  float64     `json:"latitude"`
+	Longitude float64     `json:"longitude"`
+	RadiusKm  float64     `json:"radius_km"` // every agreeing answer lies within this radius
+	Agreeing  []GpingVote `json:"agreeing"`
+	Rejected  []GpingVote `json:"rejected"`
 }
 
 type NominatimResponse struct {
@@ -51,10 +71,151 @@ type NominatimResponse struct {
 
 type PendingRequestIdsValue struct {
     DisplayName string `json:"display_name"`
-    VaultAddress string `json:"vault_address"`
     Latitude string `json:"latitude"`
     Longitude string   `json:"longitude"`    
+	RadiusKm float64 `json:"radius_km"`
+	Votes []GpingVote `json:"votes"`
+}
+// RequestState is a step in the lifecycle of an ip geo request
+type RequestState string
+
+const (
+	StateCreated          RequestState = "Created"
+	StateBroadcast        RequestState = "Broadcast"        // sent to the gpings, collecting answers
+	StateLocated          RequestState = "Located"          // gpings agreed on a location
+	StateAwaitingApproval RequestState = "AwaitingApproval" // approval or escrow transaction sent to the client
+	StateApproved         RequestState = "Approved"         // client approval or escrow payment confirmed on chain
+	StatePaid             RequestState = "Paid"             // payout to the gping vaults confirmed
+	StateDelivered        RequestState = "Delivered"        // result sent to the client
+	StateRefunded         RequestState = "Refunded"         // escrow paid back to the client
+	StateExpired          RequestState = "Expired"
+	StateFailed           RequestState = "Failed"
+)
+
+// RequestStates lists every state in lifecycle order
+var RequestStates = []RequestState{
+	StateCreated, StateBroadcast, StateLocated, StateAwaitingApproval, StateApproved,
+	StatePaid, StateDelivered, StateRefunded, StateExpired, StateFailed,
+}
+
+// Terminal reports whether no further transition can leave s
+func (s RequestState) Terminal() bool {
+	return s == StateDelivered || s == StateRefunded || s == StateExpired || s == StateFailed
 }
+
+// PaymentState tracks what the client has paid for a request, so a request
+// that fails after the client paid can be compensated
+type PaymentState string
+
+const (
+	PaymentNone            PaymentState = ""                // nothing approved or paid yet
+	PaymentAuthorized      PaymentState = "Authorized"      // allowance granted or escrow funded, nothing charged
+	PaymentCharged         PaymentState = "Charged"         // fee paid out to the gping vaults
+	PaymentRevokeRequested PaymentState = "RevokeRequested" // client asked to revoke the unused allowance
+	PaymentRefunded        PaymentState = "Refunded"        // funds paid back to the client
+)
+
+// RequestRecord is the persisted state of one ip geo request
+type RequestRecord struct {
+	RequestID string                  `json:"request_id"`
+	IP        string                  `json:"ip"`
+	State     RequestState            `json:"state"`
+	Result    *PendingRequestIdsValue `json:"result,omitempty"` // set once gpings agreed on a location
+	Mint      string                  `json:"mint"`             // token the client pays with
+	Amount    uint64                  `json:"amount"`           // price in the mint's base units
+	Decimals  uint8                   `json:"decimals"`
+	Wallet    string                  `json:"wallet"`  // client wallet paying for the request
+	Session   string                  `json:"session"` // id of the websocket client that owns the request
+	// sha256 of the token the owner can reclaim the request with from another session
+	ResumeTokenHash string `json:"resume_token_hash,omitempty"`
+	Source          string `json:"source,omitempty"` // client token account the router is approved on, or the escrow
+	// PaymentMode is "delegate" or "escrow", see config.Pricing
+	PaymentMode string `json:"payment_mode,omitempty"`
+	// base64 message of the approval transaction issued to the client, and the
+	// last block height its blockhash is valid for
+	ApprovalMessage      string `json:"approval_message,omitempty"`
+	LastValidBlockHeight uint64 `json:"last_valid_block_height,omitempty"`
+	ApprovalTx           string `json:"approval_tx,omitempty"`
+	PayoutTx             string       `json:"payout_tx,omitempty"` // confirmed payout
+	RefundTx             string       `json:"refund_tx,omitempty"` // confirmed refund
+	Payment              PaymentState `json:"payment,omitempty"`
+	CreatedAt            time.Time    `json:"created_at"`
+	UpdatedAt            time.Time    `json:"updated_at"`
+	ExpiresAt            time.Time    `json:"expires_at"` // when the current state times out
+	// payout and refund sent that may still land, settled before another is signed
+	PayoutAttempt *RouterTx `json:"payout_attempt,omitempty"`
+	RefundAttempt *RouterTx `json:"refund_attempt,omitempty"`
+}
+
+// RouterTx is a transaction paid and signed by the router that may still land.
+// Every version of it is recorded before it is sent, and no other is signed
+// until none of them can land anymore.
+type RouterTx struct {
+	Signatures           []string `json:"signatures"`
+	Signed               string   `json:"signed,omitempty"`                  // base64 of the latest version, resubmitted on retry
+	LastValidBlockHeight uint64   `json:"last_valid_block_height,omitempty"` // of the versions' blockhash
+	// durable nonce account the versions advance, kept from other transactions
+	// until they settle, and the nonce they were signed with
+	NonceAccount string `json:"nonce_account,omitempty"`
+	Nonce        string `json:"nonce,omitempty"`
+}
+
+// Kinds of LedgerEntry
+const (
+	CompensationRevoke       = "revoke"        // unused allowance, the client is asked to sign a revoke
+	CompensationEscrowRefund = "escrow_refund" // escrow paid back to the client
+	CompensationRefund       = "refund"        // fee already paid out, refunded from the router's own account
+	CompensationCreditReturn = "credit_return" // debit of a credit balance given back
+)
+
+// Statuses of LedgerEntry
+const (
+	CompensationRequested = "requested"
+	CompensationConfirmed = "confirmed"
+	CompensationFailed    = "failed"
+)
+
+// LedgerEntry is one step of a compensation owed to a client
+type LedgerEntry struct {
+	ID        string    `json:"id"`
+	RequestID string    `json:"request_id"`
+	Kind      string    `json:"kind"`
+	Status    string    `json:"status"`
+	Wallet    string    `json:"wallet"`
+	Mint      string    `json:"mint"`
+	Amount    uint64    `json:"amount"`
+	Tx        string    `json:"tx,omitempty"` // signature of the refund, or the base64 revoke transaction issued
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreditDeposit is an on-chain deposit credited to a wallet
+type CreditDeposit struct {
+	Signature  string    `json:"signature"`
+	Slot       uint64    `json:"slot"`
+	Account    string    `json:"account"` // deposit address it was paid to
+	Wallet     string    `json:"wallet"`
+	Mint       string    `json:"mint"`
+	Amount     uint64    `json:"amount"`
+	CreditedAt time.Time `json:"credited_at"`
+}
+
+// Kinds of CreditMovement
+const (
+	CreditDebit  = "debit"  // a request paid from the balance
+	CreditReturn = "return" // a debit given back because the request failed
+)
+
+// CreditMovement is a change of a wallet's credit balance other than a deposit
+type CreditMovement struct {
+	Kind      string    `json:"kind"`
+	RequestID string    `json:"request_id"`
+	Wallet    string    `json:"wallet"`
+	Mint      string    `json:"mint"`
+	Amount    uint64    `json:"amount"`
+	At        time.Time `json:"at"`
+}
+
 // type RawTxResponse
 
 // type IpGeoInfoResponse